@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Alert rule conditions. Threshold is in hours for backup_age, percent for
+// the storage conditions and a count for consecutive_failures.
+const (
+	ConditionBackupAge           = "backup_age"
+	ConditionDeviceStorage       = "device_storage"
+	ConditionServerStorage       = "server_storage"
+	ConditionConsecutiveFailures = "consecutive_failures"
+)
+
+// AlertRule is a declarative condition evaluated against the catalog. Device
+// conditions apply to DeviceID, or to the members of GroupID, or to every
+// device when both are empty.
+type AlertRule struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Condition string  `json:"condition"`
+	Threshold float64 `json:"threshold"`
+	DeviceID  string  `json:"deviceId,omitempty"`
+	GroupID   string  `json:"groupId,omitempty"`
+	Severity  string  `json:"severity"`
+	Enabled   bool    `json:"enabled"`
+}
+
+// Alert is one firing (or since resolved) instance of a rule. There is at
+// most one firing alert per rule and device.
+type Alert struct {
+	ID              string     `json:"id"`
+	RuleID          string     `json:"ruleId"`
+	RuleName        string     `json:"ruleName"`
+	DeviceID        string     `json:"deviceId,omitempty"`
+	Severity        string     `json:"severity"`
+	State           string     `json:"state"`
+	Message         string     `json:"message"`
+	Value           float64    `json:"value"`
+	StartedAt       time.Time  `json:"startedAt"`
+	LastEvaluatedAt time.Time  `json:"lastEvaluatedAt"`
+	ResolvedAt      *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Alert states
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const alertHistoryMax = 1000
+
+var alertRules = []AlertRule{
+	{ID: "1", Name: "Backup freshness", Condition: ConditionBackupAge, Threshold: 26, Severity: "warning", Enabled: true},
+	{ID: "2", Name: "Device storage", Condition: ConditionDeviceStorage, Threshold: 85, Severity: "warning", Enabled: true},
+	{ID: "3", Name: "Server storage", Condition: ConditionServerStorage, Threshold: 90, Severity: "critical", Enabled: true},
+	{ID: "4", Name: "Repeated backup failures", Condition: ConditionConsecutiveFailures, Threshold: 3, Severity: "critical", Enabled: true},
+}
+
+var (
+	alerts      = []Alert{}
+	alertSeq    int
+	nextAlertID = 5
+)
+
+// alertSubject is something a rule was evaluated against: a device, or the
+// server itself (empty deviceID).
+type alertSubject struct {
+	deviceID string
+	value    float64
+	firing   bool
+	message  string
+}
+
+func validAlertRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	switch rule.Condition {
+	case ConditionBackupAge, ConditionDeviceStorage, ConditionServerStorage, ConditionConsecutiveFailures:
+	default:
+		return fmt.Errorf("unknown condition %q", rule.Condition)
+	}
+	if rule.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	switch rule.Severity {
+	case "":
+		rule.Severity = "warning"
+	case "warning", "critical":
+	default:
+		return fmt.Errorf("severity must be warning or critical")
+	}
+	if rule.DeviceID != "" && findDevice(rule.DeviceID) == nil {
+		return fmt.Errorf("device %s not found", rule.DeviceID)
+	}
+	if rule.GroupID != "" && findGroup(rule.GroupID) == nil {
+		return fmt.Errorf("group %s not found", rule.GroupID)
+	}
+	return nil
+}
+
+func findAlertRule(id string) *AlertRule {
+	for i := range alertRules {
+		if alertRules[i].ID == id {
+			return &alertRules[i]
+		}
+	}
+	return nil
+}
+
+// ruleDevices returns the devices a device condition applies to.
+func ruleDevices(rule AlertRule) []*Device {
+	if rule.DeviceID != "" {
+		if device := findDevice(rule.DeviceID); device != nil {
+			return []*Device{device}
+		}
+		return nil
+	}
+	if rule.GroupID != "" {
+		if group := findGroup(rule.GroupID); group != nil {
+			return groupMembers(group)
+		}
+		return nil
+	}
+	result := []*Device{}
+	for i := range devices {
+		result = append(result, &devices[i])
+	}
+	return result
+}
+
+// deviceBackupsNewestFirst returns a device's backups, latest first.
+func deviceBackupsNewestFirst(deviceID string) []Backup {
+	list := []Backup{}
+	for _, backup := range backups {
+		if backup.DeviceID == deviceID {
+			list = append(list, backup)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Timestamp.After(list[j].Timestamp) })
+	return list
+}
+
+func usagePercent(used, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(used) * 100 / float64(total)
+}
+
+// evaluateRule computes the rule's value for each subject it covers.
+func evaluateRule(rule AlertRule, now time.Time) []alertSubject {
+	if rule.Condition == ConditionServerStorage {
+		percent := usagePercent(serverStatus.StorageUsed, serverStatus.StorageTotal)
+		return []alertSubject{{
+			value:   percent,
+			firing:  percent > rule.Threshold,
+			message: fmt.Sprintf("Server storage at %.1f%% (threshold %.0f%%)", percent, rule.Threshold),
+		}}
+	}
+
+	subjects := []alertSubject{}
+	for _, device := range ruleDevices(rule) {
+		s := alertSubject{deviceID: device.ID}
+		switch rule.Condition {
+		case ConditionBackupAge:
+			var latest time.Time
+			for _, backup := range deviceBackupsNewestFirst(device.ID) {
+				if backup.Status == "completed" {
+					latest = backup.Timestamp
+					break
+				}
+			}
+			if latest.IsZero() {
+				s.value = math.Inf(1)
+				s.firing = true
+				s.message = fmt.Sprintf("%s has no completed backup", device.Name)
+				break
+			}
+			s.value = now.Sub(latest).Hours()
+			s.firing = s.value > rule.Threshold
+			s.message = fmt.Sprintf("No completed backup of %s for %.0fh (threshold %.0fh)", device.Name, s.value, rule.Threshold)
+		case ConditionDeviceStorage:
+			s.value = usagePercent(device.StorageUsed, device.StorageTotal)
+			s.firing = s.value > rule.Threshold
+			s.message = fmt.Sprintf("%s storage at %.1f%% (threshold %.0f%%)", device.Name, s.value, rule.Threshold)
+		case ConditionConsecutiveFailures:
+			for _, backup := range deviceBackupsNewestFirst(device.ID) {
+				if backup.Status == "completed" {
+					break
+				}
+				if backup.Status == "failed" {
+					s.value++
+				}
+			}
+			s.firing = s.value >= rule.Threshold
+			s.message = fmt.Sprintf("%.0f consecutive failed backups of %s", s.value, device.Name)
+		}
+		subjects = append(subjects, s)
+	}
+	return subjects
+}
+
+func findFiringAlert(ruleID, deviceID string) *Alert {
+	for i := range alerts {
+		if alerts[i].State == AlertFiring && alerts[i].RuleID == ruleID && alerts[i].DeviceID == deviceID {
+			return &alerts[i]
+		}
+	}
+	return nil
+}
+
+// jsonValue keeps +Inf (no backup at all) out of the JSON encoder's way.
+func jsonValue(v float64) float64 {
+	if math.IsInf(v, 0) {
+		return -1
+	}
+	return v
+}
+
+// evaluateAlerts evaluates every enabled rule, opening alerts for newly
+// firing conditions and resolving those that cleared, then refreshes device
+// statuses. The caller must hold dataMu.
+func evaluateAlerts(now time.Time) {
+	active := map[string]bool{}
+	for _, rule := range alertRules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, s := range evaluateRule(rule, now) {
+			alert := findFiringAlert(rule.ID, s.deviceID)
+			if !s.firing {
+				continue
+			}
+			if alert != nil {
+				// Deduplicate: keep the open alert current rather than raising it again.
+				alert.Value = jsonValue(s.value)
+				alert.Message = s.message
+				alert.LastEvaluatedAt = now
+				active[alert.ID] = true
+				continue
+			}
+			alertSeq++
+			alerts = append(alerts, Alert{
+				ID:              fmt.Sprintf("alert-%d", alertSeq),
+				RuleID:          rule.ID,
+				RuleName:        rule.Name,
+				DeviceID:        s.deviceID,
+				Severity:        rule.Severity,
+				State:           AlertFiring,
+				Message:         s.message,
+				Value:           jsonValue(s.value),
+				StartedAt:       now,
+				LastEvaluatedAt: now,
+			})
+			level := "warning"
+			if rule.Severity == "critical" {
+				level = "error"
+			}
+			emitEvent(EventAlertFiring, BackupLog{
+				Timestamp: now,
+				Level:     level,
+				Message:   fmt.Sprintf("Alert %q firing: %s", rule.Name, s.message),
+				DeviceID:  s.deviceID,
+			}, map[string]interface{}{"alertId": alerts[len(alerts)-1].ID, "ruleId": rule.ID, "severity": rule.Severity})
+			active[alerts[len(alerts)-1].ID] = true
+		}
+	}
+
+	// Anything still firing that wasn't confirmed above has cleared, or its
+	// rule was disabled or deleted.
+	for i := range alerts {
+		alert := &alerts[i]
+		if alert.State != AlertFiring || active[alert.ID] {
+			continue
+		}
+		resolvedAt := now
+		alert.State = AlertResolved
+		alert.ResolvedAt = &resolvedAt
+		alert.LastEvaluatedAt = now
+		emitEvent(EventAlertResolved, BackupLog{
+			Timestamp: now,
+			Level:     "info",
+			Message:   fmt.Sprintf("Alert %q resolved", alert.RuleName),
+			DeviceID:  alert.DeviceID,
+		}, map[string]interface{}{"alertId": alert.ID, "ruleId": alert.RuleID})
+	}
+	trimAlertHistory()
+
+	for i := range devices {
+		refreshDeviceStatus(&devices[i])
+	}
+}
+
+// trimAlertHistory drops the oldest resolved alerts beyond alertHistoryMax.
+func trimAlertHistory() {
+	excess := len(alerts) - alertHistoryMax
+	if excess <= 0 {
+		return
+	}
+	kept := alerts[:0]
+	for _, alert := range alerts {
+		if excess > 0 && alert.State == AlertResolved {
+			excess--
+			continue
+		}
+		kept = append(kept, alert)
+	}
+	alerts = kept
+}
+
+// refreshDeviceStatus derives an online device's status from its firing
+// alerts and last restore test. Offline devices are left to the monitor.
+func refreshDeviceStatus(device *Device) {
+	if device.Status == "offline" {
+		return
+	}
+	status := "online"
+	if device.RestoreTestStatus == "failed" {
+		status = "warning"
+	}
+	for _, alert := range alerts {
+		if alert.State == AlertFiring && alert.DeviceID == device.ID {
+			status = "warning"
+			break
+		}
+	}
+	device.Status = status
+}
+
+// alertRoutine evaluates alert rules on a fixed interval.
+func alertRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dataMu.Lock()
+		evaluateAlerts(time.Now())
+		dataMu.Unlock()
+	}
+}
+
+func alertInterval() (time.Duration, error) {
+	if v := os.Getenv("ALERT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ALERT_INTERVAL: %s", err)
+		}
+		return d, nil
+	}
+	return time.Minute, nil
+}
+
+// Alert handlers
+func getAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	result := []Alert{}
+	for i := len(alerts) - 1; i >= 0; i-- {
+		alert := alerts[i]
+		if v := q.Get("state"); v != "" && alert.State != v {
+			continue
+		}
+		if v := q.Get("severity"); v != "" && alert.Severity != v {
+			continue
+		}
+		if v := q.Get("deviceId"); v != "" && alert.DeviceID != v {
+			continue
+		}
+		if v := q.Get("ruleId"); v != "" && alert.RuleID != v {
+			continue
+		}
+		result = append(result, alert)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func evaluateAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	evaluateAlerts(time.Now())
+
+	firing := []Alert{}
+	for _, alert := range alerts {
+		if alert.State == AlertFiring {
+			firing = append(firing, alert)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(firing)
+}
+
+func getAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alertRules)
+}
+
+func createAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validAlertRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = fmt.Sprintf("%d", nextAlertID)
+	nextAlertID++
+	alertRules = append(alertRules, rule)
+	setAuditResource(r, "alert-rule/"+rule.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func updateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	existing := findAlertRule(mux.Vars(r)["id"])
+	if existing == nil {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validAlertRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = existing.ID
+	*existing = rule
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for i := range alertRules {
+		if alertRules[i].ID == id {
+			alertRules = append(alertRules[:i], alertRules[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Alert rule not found", http.StatusNotFound)
+}
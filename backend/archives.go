@@ -0,0 +1,619 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func getArchiveDir() string {
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		return dir
+	}
+	return "archives"
+}
+
+// archiveKey is the storage key of a backup's encrypted archive.
+func archiveKey(backup *Backup) string {
+	return backup.DeviceID + "/" + backup.ID + ".enc"
+}
+
+// Backups whose archive is being uploaded, guarded by dataMu. Only one
+// upload per backup runs at a time.
+var uploadsInProgress = map[string]bool{}
+
+// agentWarningLimit caps how many agent warnings are spelled out in the log
+// message.
+const agentWarningLimit = 10
+
+// validBackupID rejects ids that are empty or could escape the archive
+// directory once used as a file name.
+func validBackupID(id string) bool {
+	if id == "" || id == "." || id == ".." || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveReader is a seekable plaintext view of a stored archive.
+type archiveReader struct {
+	io.ReadSeeker
+	modTime time.Time
+}
+
+// ModTime returns when the archive was stored.
+func (a *archiveReader) ModTime() time.Time {
+	return a.modTime
+}
+
+// Close is a no-op; reads go through the storage backend per request.
+func (a *archiveReader) Close() error {
+	return nil
+}
+
+// openArchive returns a seekable plaintext reader for a stored archive,
+// falling back to a verified replica when the primary copy can't be read.
+// Archives on the cold tier are staged back to local storage first.
+// Missing archives are reported as ErrObjectNotFound.
+func openArchive(backup *Backup) (*archiveReader, error) {
+	if backup.Tier == TierCold {
+		if reader, err := openStagedArchive(backup); err == nil {
+			return reader, nil
+		} else if err != ErrObjectNotFound {
+			return nil, fmt.Errorf("failed to stage archive from cold storage: %s", err)
+		}
+	}
+	store, err := storageFor(backup)
+	if err == nil {
+		var reader *archiveReader
+		if reader, err = openArchiveOn(backup, store); err == nil {
+			return reader, nil
+		}
+	}
+	for _, c := range backup.Copies {
+		replica, ok := storageBackends[c.Target]
+		if c.Status != CopyVerified || c.Target == backup.Storage || !ok {
+			continue
+		}
+		if reader, rerr := openArchiveOn(backup, replica); rerr == nil {
+			return reader, nil
+		}
+	}
+	return nil, err
+}
+
+// openArchiveOn opens the copy of a backup's archive held by store.
+func openArchiveOn(backup *Backup, store Storage) (*archiveReader, error) {
+	if backup.Chunked {
+		return openChunkedArchive(backup, store)
+	}
+	return openArchiveObject(backup, store, archiveKey(backup))
+}
+
+// openArchiveObject decrypts the archive stored under key with the backup's
+// device key.
+func openArchiveObject(backup *Backup, store Storage, key string) (*archiveReader, error) {
+	info, err := store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := deviceDataKey(backup.DeviceID, false)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newDecryptingReader(&objectReaderAt{store: store, key: key, size: info.Size}, info.Size, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveReader{ReadSeeker: reader, modTime: info.ModTime}, nil
+}
+
+// archiveExists reports whether the server holds a backup's archive.
+func archiveExists(backup *Backup) bool {
+	store, err := storageFor(backup)
+	if err != nil {
+		return false
+	}
+	if backup.Chunked {
+		return hasChunks(backup, store)
+	}
+	_, err = store.Stat(archiveKey(backup))
+	return err == nil
+}
+
+// removeArchive deletes a backup's archive from its storage backend.
+func removeArchive(backup *Backup) error {
+	store, err := storageFor(backup)
+	if err != nil {
+		return err
+	}
+	return deleteArchiveFrom(backup, store)
+}
+
+// deleteArchiveFrom deletes the copy of a backup's archive held by store;
+// for a chunked archive that releases its chunks there.
+func deleteArchiveFrom(backup *Backup, store Storage) error {
+	if backup.Chunked {
+		index := backupChunkIndex(backup.ID)
+		if index == nil {
+			return nil
+		}
+		return releaseChunks(store, index.Chunks)
+	}
+	return store.Delete(archiveKey(backup))
+}
+
+// storeArchive puts src on the active storage backend, deduplicated into
+// chunks when enabled, and records where it went in backup.Storage and
+// backup.Chunked. It returns the number of plaintext bytes stored.
+func storeArchive(backup *Backup, src io.Reader) (int64, error) {
+	if dedupEnabled {
+		return storeChunkedArchive(backup, src)
+	}
+	n, storage, err := storeArchiveObject(backup, src)
+	if err != nil {
+		return n, err
+	}
+	if backup.Chunked {
+		// Previously stored as chunks, before dedup was turned off.
+		removeArchive(backup)
+		forgetChunkIndex(backup.ID)
+	}
+	backup.Storage = storage
+	backup.Chunked = false
+	return n, nil
+}
+
+// storeArchiveObject encrypts src under the device's data key and puts it on
+// the active storage backend as a single object, returning the number of
+// plaintext bytes stored and the backend's name. The ciphertext is staged in
+// a local temp file so drivers get a known size.
+func storeArchiveObject(backup *Backup, src io.Reader) (int64, string, error) {
+	key, err := deviceDataKey(backup.DeviceID, true)
+	if err != nil {
+		return 0, "", err
+	}
+
+	staging := filepath.Join(getArchiveDir(), "incoming")
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return 0, "", fmt.Errorf("failed to create staging directory: %s", err)
+	}
+	tmp, err := os.CreateTemp(staging, backup.ID+".*.tmp")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create archive file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	ew, err := newEncryptingWriter(tmp, key)
+	if err != nil {
+		tmp.Close()
+		return 0, "", err
+	}
+	n, err := io.Copy(ew, src)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, "", fmt.Errorf("failed to write archive: %s", err)
+	}
+
+	store := activeStorage
+	if fp, ok := store.(filePutter); ok {
+		err = fp.PutFile(archiveKey(backup), tmp.Name())
+	} else {
+		var f *os.File
+		if f, err = os.Open(tmp.Name()); err == nil {
+			var info os.FileInfo
+			if info, err = f.Stat(); err == nil {
+				err = store.Put(archiveKey(backup), f, info.Size())
+			}
+			f.Close()
+		}
+	}
+	if err != nil {
+		return n, "", fmt.Errorf("failed to store archive on %s: %s", store.Name(), err)
+	}
+	return n, store.Name(), nil
+}
+
+// Archive handlers
+func createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Backup
+		Manifest *Manifest `json:"manifest,omitempty"`
+		// Problems the agent skipped over, such as missing include paths.
+		Warnings []string `json:"warnings,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newBackup := req.Backup
+	setAuditResource(r, "backup/"+newBackup.ID)
+
+	if !validBackupID(newBackup.ID) {
+		http.Error(w, "Invalid backup id", http.StatusBadRequest)
+		return
+	}
+
+	// Manifests can be large, so only lock once the body has been decoded.
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	if findBackup(newBackup.ID) != nil {
+		http.Error(w, "Backup already exists", http.StatusConflict)
+		return
+	}
+	device := findDevice(newBackup.DeviceID)
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if newBackup.DeviceName == "" {
+		newBackup.DeviceName = device.Name
+	}
+	if newBackup.Timestamp.IsZero() {
+		newBackup.Timestamp = time.Now()
+	}
+	// The agent keeps the archive it reports; everything else about where
+	// the backup lives, and how it relates to consolidated chains, is
+	// tracked by the server. Pinning is left to operators.
+	newBackup.VerifyStatus = ""
+	newBackup.VerifiedAt = nil
+	newBackup.Storage = ""
+	newBackup.Copies = nil
+	newBackup.Tier = ""
+	newBackup.Chunked = false
+	newBackup.SynthesizedFrom = ""
+	newBackup.ConsolidatedInto = ""
+	newBackup.Pinned = false
+	if err := validateParent(&newBackup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if newBackup.Location == "local" || newBackup.Location == "both" {
+		newBackup.Copies = []ArchiveCopy{{Target: deviceCopyTarget, Status: CopyReported}}
+	}
+	newBackup.Location = archiveLocation(&newBackup)
+	if req.Manifest != nil {
+		if newBackup.ArchiveSHA256 == "" {
+			newBackup.ArchiveSHA256 = req.Manifest.ArchiveSHA256
+		}
+		if req.Manifest.ArchiveSHA256 != newBackup.ArchiveSHA256 {
+			http.Error(w, "Manifest archive hash does not match backup", http.StatusBadRequest)
+			return
+		}
+		// The server must never learn what an end-to-end encrypted backup
+		// holds, so its manifest may only be sealed.
+		if newBackup.EncryptionKey != "" && (len(req.Manifest.Entries) > 0 || len(req.Manifest.Deleted) > 0) {
+			http.Error(w, "End-to-end encrypted backups must not send plaintext manifest entries", http.StatusBadRequest)
+			return
+		}
+		if newBackup.EncryptionKey == "" && req.Manifest.Sealed != "" {
+			http.Error(w, "Only end-to-end encrypted backups can send a sealed manifest", http.StatusBadRequest)
+			return
+		}
+		setManifest(newBackup.ID, req.Manifest)
+	}
+
+	backups = append(backups, newBackup)
+	touchDevice(newBackup.DeviceID)
+
+	if newBackup.Status == "failed" {
+		// The agent couldn't create the archive and is only reporting it.
+		emitEvent(EventBackupFailed, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "error",
+			Message:   "Backup failed on device",
+			DeviceID:  newBackup.DeviceID,
+			BackupID:  newBackup.ID,
+		}, nil)
+	} else {
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "info",
+			Message:   "Backup registered",
+			DeviceID:  newBackup.DeviceID,
+			BackupID:  newBackup.ID,
+		})
+	}
+	if len(req.Warnings) > 0 {
+		listed := req.Warnings
+		if len(listed) > agentWarningLimit {
+			listed = append(listed[:agentWarningLimit:agentWarningLimit], fmt.Sprintf("and %d more", len(req.Warnings)-agentWarningLimit))
+		}
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message:   fmt.Sprintf("Agent reported %d warning(s): %s", len(req.Warnings), strings.Join(listed, "; ")),
+			DeviceID:  newBackup.DeviceID,
+			BackupID:  newBackup.ID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBackup)
+}
+
+func uploadArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+
+	dataMu.Lock()
+	found := findBackup(backupID)
+	var backup Backup
+	busy := false
+	if found != nil {
+		backup = *found
+		busy = uploadsInProgress[backupID]
+		if !busy {
+			uploadsInProgress[backupID] = true
+			defer func() {
+				dataMu.Lock()
+				delete(uploadsInProgress, backupID)
+				dataMu.Unlock()
+			}()
+		}
+	}
+	dataMu.Unlock()
+
+	if found == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if busy {
+		http.Error(w, "An upload of this backup is already in progress", http.StatusConflict)
+		return
+	}
+	if !encryptionConfigured() {
+		http.Error(w, "Archive encryption is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Reject over-quota uploads before reading the body, using the size the
+	// agent declared; the stored size is checked again below.
+	incoming := backup.Size
+	if r.ContentLength > incoming {
+		incoming = r.ContentLength
+	}
+	dataMu.Lock()
+	reason := checkQuota(backup.DeviceID, backupID, incoming)
+	if reason != "" {
+		rejectUpload(backupID, backup.DeviceID, reason)
+	}
+	dataMu.Unlock()
+	if reason != "" {
+		http.Error(w, "Upload rejected: "+reason, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	h := sha256.New()
+	previous := backup
+	n, err := storeArchive(&backup, io.TeeReader(r.Body, h))
+	sum := hex.EncodeToString(h.Sum(nil))
+	// Once stored, the new archive has replaced any earlier upload.
+	replaced := err == nil
+	if err == nil && previous.Storage != "" && !previous.Chunked &&
+		(previous.Storage != backup.Storage || backup.Chunked) {
+		// Re-uploaded to another backend or as chunks; drop the old object.
+		// storeArchive already released the chunks of a chunked one.
+		removeArchive(&previous)
+	}
+	if err == nil && backup.Size > 0 && n != backup.Size {
+		removeArchive(&backup)
+		err = fmt.Errorf("received %d bytes, expected %d", n, backup.Size)
+	}
+	if err == nil && backup.ArchiveSHA256 != "" && sum != backup.ArchiveSHA256 {
+		removeArchive(&backup)
+		err = fmt.Errorf("archive sha256 %s does not match %s", sum, backup.ArchiveSHA256)
+	}
+
+	var manifest *Manifest
+	var manifestErr error
+	dataMu.Lock()
+	_, hasManifest := manifests[backupID]
+	dataMu.Unlock()
+	if err == nil && !hasManifest && backup.EncryptionKey == "" {
+		manifest, manifestErr = buildManifest(&backup)
+	}
+
+	dataMu.Lock()
+	defer dataMu.Unlock()
+
+	// Uploads take a while; look the backup up again rather than writing
+	// through a pointer into a slice that may have been reallocated.
+	stored := findBackup(backupID)
+	if err != nil {
+		if stored != nil {
+			stored.Status = "failed"
+			if replaced {
+				releaseStorageUsed(stored)
+				stored.Chunked = backup.Chunked
+				dropArchiveRecord(stored)
+			}
+		}
+		emitEvent(EventBackupFailed, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "error",
+			Message:   fmt.Sprintf("Backup upload failed: %s", err),
+			DeviceID:  backup.DeviceID,
+			BackupID:  backupID,
+		}, nil)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if stored == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if reason := checkQuota(backup.DeviceID, backupID, n); reason != "" {
+		removeArchive(&backup)
+		releaseStorageUsed(stored)
+		stored.Chunked = backup.Chunked
+		dropArchiveRecord(stored)
+		rejectUpload(backupID, backup.DeviceID, reason)
+		http.Error(w, "Upload rejected: "+reason, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// A re-upload replaces the archive counted for the earlier one.
+	releaseStorageUsed(stored)
+	stored.Size = n
+	stored.ArchiveSHA256 = sum
+	stored.Storage = backup.Storage
+	stored.Chunked = backup.Chunked
+	stored.Status = "completed"
+	verifiedAt := time.Now()
+	copies := []ArchiveCopy{}
+	for _, c := range stored.Copies {
+		// A re-upload replaces every server-side copy.
+		if c.Target == deviceCopyTarget {
+			copies = append(copies, c)
+		}
+	}
+	stored.Copies = append(copies, ArchiveCopy{
+		Target:     backup.Storage,
+		Status:     CopyVerified,
+		SHA256:     sum,
+		Size:       n,
+		Attempts:   1,
+		VerifiedAt: &verifiedAt,
+	})
+	stored.Location = archiveLocation(stored)
+	stored.Tier = TierHot
+	unstageArchive(backupID)
+	if manifestErr != nil {
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message:   fmt.Sprintf("Failed to build manifest: %s", manifestErr),
+			DeviceID:  backup.DeviceID,
+			BackupID:  backupID,
+		})
+	} else if manifest != nil {
+		setManifest(backupID, manifest)
+		stored.Files = len(manifest.Entries)
+	}
+	if device := findDevice(backup.DeviceID); device != nil {
+		device.LastBackup = stored.Timestamp
+	}
+	lastBackupTime := stored.Timestamp
+	serverStatus.LastBackupTime = &lastBackupTime
+	serverStatus.StorageUsed += n
+	touchDevice(backup.DeviceID)
+
+	emitEvent(EventBackupCompleted, BackupLog{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   "Backup uploaded to server",
+		DeviceID:  backup.DeviceID,
+		BackupID:  backupID,
+	}, map[string]interface{}{"size": n, "archiveSha256": sum})
+	detectDrift(stored)
+	warnQuotas(backup.DeviceID, backupID)
+	if planReplicas(stored) {
+		go replicateBackup(backupID, false)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
+
+// releaseStorageUsed takes a backup's archive out of the server's storage
+// total once it is replaced or deleted. Only hot archives stored on the
+// server are counted. The caller must hold dataMu.
+func releaseStorageUsed(backup *Backup) {
+	if backup.Storage != "" && backup.Tier != TierCold {
+		serverStatus.StorageUsed -= backup.Size
+	}
+}
+
+// dropArchiveRecord forgets a backup's server-side copies after its
+// archive was deleted. The caller must hold dataMu.
+func dropArchiveRecord(backup *Backup) {
+	if backup.Chunked {
+		forgetChunkIndex(backup.ID)
+	}
+	backup.Storage = ""
+	backup.Chunked = false
+	copies := []ArchiveCopy{}
+	for _, c := range backup.Copies {
+		if c.Target == deviceCopyTarget {
+			copies = append(copies, c)
+		}
+	}
+	backup.Copies = copies
+	backup.Location = archiveLocation(backup)
+}
+
+// rejectUpload marks a backup failed because its upload broke a quota.
+// The caller must hold dataMu.
+func rejectUpload(backupID, deviceID, reason string) {
+	if stored := findBackup(backupID); stored != nil {
+		stored.Status = "failed"
+	}
+	emitEvent(EventBackupFailed, BackupLog{
+		Timestamp: time.Now(),
+		Level:     "error",
+		Message:   fmt.Sprintf("Backup upload rejected: %s", reason),
+		DeviceID:  deviceID,
+		BackupID:  backupID,
+	}, map[string]interface{}{"reason": "quota"})
+}
+
+func downloadArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+
+	dataMu.Lock()
+	found := findBackup(backupID)
+	var backup Backup
+	if found != nil {
+		backup = *found
+	}
+	dataMu.Unlock()
+
+	if found == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+
+	reader, err := openArchive(&backup)
+	if err == ErrObjectNotFound {
+		http.Error(w, "Archive not stored on server", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// ServeContent handles Range, If-Range and the conditional headers; the
+	// archive hash makes a strong ETag so interrupted downloads can resume.
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, backup.ID))
+	if backup.ArchiveSHA256 != "" {
+		w.Header().Set("ETag", `"`+backup.ArchiveSHA256+`"`)
+	}
+	http.ServeContent(w, r, "", reader.ModTime(), reader)
+}
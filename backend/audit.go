@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry records a single mutating API call (or an audited read, see
+// auditAccess). Entries are hash-chained:
+// each Hash is an HMAC, under a key only the server holds, of the entry's
+// fields plus the previous entry's Hash, so editing or removing any entry
+// breaks verification of everything after it. Cutting entries off the end
+// is caught by the signed head kept next to the log file (see auditHead).
+//
+// The server has no authentication of its own, so Actor is always
+// "anonymous"; the BasicAuth user or X-Device-ID a client sent is kept in
+// ClaimedActor and must not be taken as proof of who made the call.
+type AuditEntry struct {
+	Seq          int64     `json:"seq"`
+	Timestamp    time.Time `json:"timestamp"`
+	Actor        string    `json:"actor"`
+	ClaimedActor string    `json:"claimedActor,omitempty"`
+	SourceIP     string    `json:"sourceIp"`
+	Method       string    `json:"method"`
+	Route        string    `json:"route"`
+	Resource     string    `json:"resource,omitempty"`
+	Result       string    `json:"result"`
+	Status       int       `json:"status"`
+	PrevHash     string    `json:"prevHash"`
+	Hash         string    `json:"hash"`
+}
+
+// auditHead is the latest entry of the log file, signed with the audit key
+// and rewritten after every append. An entry missing from the end of the
+// log no longer matches it. Export it (GET /api/audit/verify) to detect
+// the log and head being rolled back together.
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac"`
+}
+
+// Audit log (append-only, optionally mirrored to a JSON-lines file)
+var (
+	auditMu   sync.Mutex
+	auditLog  []AuditEntry
+	auditFile *os.File
+	auditKey  []byte
+	// Size of the log file up to the last complete entry.
+	auditSize int64
+)
+
+type auditContextKey struct{}
+
+// auditRecord is carried in the request context so handlers can refine the
+// target resource when it isn't visible in the URL (e.g. schedule updates),
+// or ask for a read to be audited (e.g. pulling files out of a backup).
+type auditRecord struct {
+	resource string
+	audit    bool
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, auditKey)
+	mac.Write([]byte(e.PrevHash))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h auditHead) computeMAC() string {
+	mac := hmac.New(sha256.New, auditKey)
+	fmt.Fprintf(mac, "audit-head:%d:%s", h.Seq, h.Hash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadAuditKey reads the audit key from AUDIT_HMAC_KEY or the file named by
+// AUDIT_HMAC_KEY_FILE, and otherwise uses the one kept in the key store, so
+// rotating the master key doesn't invalidate the log.
+func loadAuditKey() ([]byte, error) {
+	if v := os.Getenv("AUDIT_HMAC_KEY"); v != "" {
+		return parseKey(v)
+	}
+	if path := os.Getenv("AUDIT_HMAC_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit key file: %s", err)
+		}
+		return parseKey(string(data))
+	}
+	return auditDataKey()
+}
+
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// openAuditLog loads an existing audit file, verifies its chain against the
+// signed head and keeps it open for appending. A trailing line left partial
+// by a failed write is cut off. An empty path keeps the audit log in memory
+// only.
+func openAuditLog(path string) error {
+	key, err := loadAuditKey()
+	if err != nil {
+		return err
+	}
+	if key == nil && path != "" {
+		return fmt.Errorf("audit log needs AUDIT_HMAC_KEY, AUDIT_HMAC_KEY_FILE or a master key")
+	}
+	auditKey = key
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			// Only the last write can have been cut short.
+			fmt.Printf("Warning: dropping partial trailing audit log line (%d bytes)\n", len(data))
+			if err := os.Truncate(path, auditSize); err != nil {
+				return fmt.Errorf("failed to repair audit log: %s", err)
+			}
+			break
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(data[:end], &entry); err != nil {
+			return fmt.Errorf("failed to parse audit log: %s", err)
+		}
+		auditLog = append(auditLog, entry)
+		auditSize += int64(end + 1)
+		data = data[end+1:]
+	}
+	if bad := verifyAuditChain(auditLog); bad >= 0 {
+		return fmt.Errorf("audit log chain broken at seq %d", auditLog[bad].Seq)
+	}
+	if err := checkAuditHead(path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	auditFile = f
+	return nil
+}
+
+// checkAuditHead makes sure no entries were cut off the end of the log. The
+// head is written after the entry, so it may lag the log by one entry after
+// a crash, but never lead it.
+func checkAuditHead(path string) error {
+	data, err := os.ReadFile(auditHeadPath(path))
+	if os.IsNotExist(err) {
+		if len(auditLog) > 0 {
+			return fmt.Errorf("audit log head %s is missing", auditHeadPath(path))
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit log head: %s", err)
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return fmt.Errorf("failed to parse audit log head: %s", err)
+	}
+	if !hmac.Equal([]byte(head.MAC), []byte(head.computeMAC())) {
+		return fmt.Errorf("audit log head signature does not match")
+	}
+	if head.Seq == 0 {
+		return nil
+	}
+	for _, entry := range auditLog {
+		if entry.Seq == head.Seq {
+			if entry.Hash != head.Hash {
+				return fmt.Errorf("audit log entry %d does not match the head", head.Seq)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("audit log is truncated: head is at seq %d", head.Seq)
+}
+
+// writeAuditHead replaces the head atomically. The caller must hold auditMu.
+func writeAuditHead(entry AuditEntry) error {
+	head := auditHead{Seq: entry.Seq, Hash: entry.Hash}
+	head.MAC = head.computeMAC()
+	data, _ := json.Marshal(head)
+	path := auditHeadPath(auditFile.Name())
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// appendAudit adds an entry to the log. If the entry can't be written in
+// full, the file is cut back to the last complete entry and the entry is
+// dropped from memory as well, so the log on disk stays loadable.
+func appendAudit(entry AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	entry.Seq = 1
+	entry.PrevHash = ""
+	if n := len(auditLog); n > 0 {
+		entry.Seq = auditLog[n-1].Seq + 1
+		entry.PrevHash = auditLog[n-1].Hash
+	}
+	entry.Hash = entry.computeHash()
+
+	if auditFile != nil {
+		data, _ := json.Marshal(entry)
+		data = append(data, '\n')
+		if _, err := auditFile.Write(data); err != nil {
+			if terr := auditFile.Truncate(auditSize); terr != nil {
+				err = fmt.Errorf("%s (and failed to cut off the partial entry: %s)", err, terr)
+			}
+			return fmt.Errorf("failed to write audit entry %d: %s", entry.Seq, err)
+		}
+		auditSize += int64(len(data))
+		if err := writeAuditHead(entry); err != nil {
+			fmt.Printf("Failed to update audit log head: %s\n", err)
+		}
+	}
+	auditLog = append(auditLog, entry)
+	return nil
+}
+
+// verifyAuditChain returns the index of the first entry whose hash or link
+// doesn't match, or -1 if the chain is intact.
+func verifyAuditChain(entries []AuditEntry) int {
+	prev := ""
+	for i, entry := range entries {
+		if entry.PrevHash != prev || entry.computeHash() != entry.Hash {
+			return i
+		}
+		prev = entry.Hash
+	}
+	return -1
+}
+
+// requestClaimedActor is who the client says it is. Nothing verifies it.
+func requestClaimedActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	if deviceID := r.Header.Get("X-Device-ID"); deviceID != "" {
+		return "device:" + deviceID
+	}
+	return ""
+}
+
+func requestSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditResourceKinds names the resource behind each route prefix that
+// identifies it by {id}.
+var auditResourceKinds = map[string]string{
+	"alert-rules":          "alert-rule",
+	"backups":              "backup",
+	"devices":              "device",
+	"groups":               "group",
+	"replication-policies": "replication-policy",
+	"restore-tests":        "restore-test",
+	"tiering-rules":        "tiering-rule",
+	"webhooks":             "webhook",
+}
+
+// auditResource derives the target resource from the route variables.
+func auditResource(route string, vars map[string]string) string {
+	if id := vars["backupId"]; id != "" {
+		return "backup/" + id
+	}
+	if id := vars["deviceId"]; id != "" {
+		return "device/" + id
+	}
+	if id := vars["id"]; id != "" {
+		prefix, _, _ := strings.Cut(strings.TrimPrefix(route, "/api/"), "/")
+		kind, ok := auditResourceKinds[prefix]
+		if !ok {
+			kind = prefix
+		}
+		return kind + "/" + id
+	}
+	return ""
+}
+
+// setAuditResource lets a handler name the resource it acted on.
+func setAuditResource(r *http.Request, resource string) {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		rec.resource = resource
+	}
+}
+
+// auditAccess records a non-mutating request in the audit log, for reads
+// that expose backup contents.
+func auditAccess(r *http.Request, resource string) {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		rec.resource = resource
+		rec.audit = true
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush a streamed archive.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// auditMiddleware records every mutating request, and any read a handler
+// flags with auditAccess, once the handler returns.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutating := false
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			mutating = true
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		rec := &auditRecord{resource: auditResource(route, mux.Vars(r)), audit: mutating}
+		sw := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec)))
+
+		if !rec.audit {
+			return
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		result := "success"
+		if sw.status >= 400 {
+			result = "failure"
+		}
+		err := appendAudit(AuditEntry{
+			Timestamp:    time.Now(),
+			Actor:        "anonymous",
+			ClaimedActor: requestClaimedActor(r),
+			SourceIP:     requestSourceIP(r),
+			Method:       r.Method,
+			Route:        route,
+			Resource:     rec.resource,
+			Result:       result,
+			Status:       sw.status,
+		})
+		if err != nil {
+			fmt.Printf("Audit log: %s\n", err)
+		}
+	})
+}
+
+// Audit handlers
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var since, until time.Time
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: %s", name, err), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	auditMu.Lock()
+	entries := []AuditEntry{}
+	for _, entry := range auditLog {
+		if v := q.Get("actor"); v != "" && entry.Actor != v {
+			continue
+		}
+		if v := q.Get("claimedActor"); v != "" && entry.ClaimedActor != v {
+			continue
+		}
+		if v := q.Get("sourceIp"); v != "" && entry.SourceIP != v {
+			continue
+		}
+		if v := q.Get("method"); v != "" && !strings.EqualFold(entry.Method, v) {
+			continue
+		}
+		if v := q.Get("route"); v != "" && !strings.Contains(entry.Route, v) {
+			continue
+		}
+		if v := q.Get("resource"); v != "" && entry.Resource != v {
+			continue
+		}
+		if v := q.Get("result"); v != "" && entry.Result != v {
+			continue
+		}
+		if !since.IsZero() && entry.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && entry.Timestamp.After(until) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	auditMu.Unlock()
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			enc.Encode(entry)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"seq", "timestamp", "actor", "claimedActor", "sourceIp", "method", "route", "resource", "result", "status", "prevHash", "hash"})
+		for _, e := range entries {
+			cw.Write([]string{
+				strconv.FormatInt(e.Seq, 10), e.Timestamp.Format(time.RFC3339Nano), e.Actor, e.ClaimedActor, e.SourceIP,
+				e.Method, e.Route, e.Resource, e.Result, strconv.Itoa(e.Status), e.PrevHash, e.Hash,
+			})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+	}
+}
+
+func verifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	auditMu.Lock()
+	bad := verifyAuditChain(auditLog)
+	count := len(auditLog)
+	var badSeq int64
+	if bad >= 0 {
+		badSeq = auditLog[bad].Seq
+	}
+	var head auditHead
+	if count > 0 {
+		head = auditHead{Seq: auditLog[count-1].Seq, Hash: auditLog[count-1].Hash}
+		head.MAC = head.computeMAC()
+	}
+	auditMu.Unlock()
+
+	// The head is returned so it can be recorded outside the server; a log
+	// that no longer reaches a recorded head has lost entries.
+	result := map[string]interface{}{
+		"valid":   bad < 0,
+		"entries": count,
+		"head":    head,
+	}
+	if bad >= 0 {
+		result["brokenAtSeq"] = badSeq
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// IndexEntry is one file or directory inside a backup, as listed by the
+// browse endpoint.
+type IndexEntry struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Mode       int64     `json:"mode"`
+	ModTime    time.Time `json:"mtime"`
+	SHA256     string    `json:"sha256,omitempty"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
+// FileListing is a page of a directory listing.
+type FileListing struct {
+	Path       string       `json:"path"`
+	Entries    []IndexEntry `json:"entries"`
+	Total      int          `json:"total"`
+	Offset     int          `json:"offset"`
+	Limit      int          `json:"limit"`
+	NextOffset *int         `json:"nextOffset,omitempty"`
+}
+
+// fileIndex maps each directory in a backup to its sorted children. It is
+// built from the backup's merged manifest the first time it is needed, so
+// listing never touches the archive.
+type fileIndex struct {
+	dirs  map[string][]IndexEntry
+	files map[string]IndexEntry
+}
+
+const (
+	defaultListLimit = 200
+	maxListLimit     = 1000
+)
+
+// File indexes by backup ID, see backupFileIndex.
+var fileIndexes = map[string]*fileIndex{}
+
+// indexPath normalizes archive entry names ("etc/hosts", "etc/") and query
+// paths ("/etc/") to the same absolute form ("/etc/hosts", "/etc").
+func indexPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func buildFileIndex(manifest *Manifest) *fileIndex {
+	idx := &fileIndex{dirs: map[string][]IndexEntry{"/": {}}, files: map[string]IndexEntry{}}
+
+	var addDir func(p string)
+	addDir = func(p string) {
+		if _, ok := idx.dirs[p]; ok {
+			return
+		}
+		idx.dirs[p] = []IndexEntry{}
+		parent := path.Dir(p)
+		addDir(parent)
+		// Archives don't always carry entries for intermediate directories.
+		if _, ok := idx.files[p]; !ok {
+			entry := IndexEntry{Name: path.Base(p), Path: p, Type: "dir"}
+			idx.files[p] = entry
+			idx.dirs[parent] = append(idx.dirs[parent], entry)
+		}
+	}
+
+	for _, m := range manifest.Entries {
+		p := indexPath(m.Path)
+		if p == "/" {
+			continue
+		}
+		entry := IndexEntry{
+			Name:       path.Base(p),
+			Path:       p,
+			Type:       m.Type,
+			Size:       m.Size,
+			Mode:       m.Mode,
+			ModTime:    m.ModTime,
+			SHA256:     m.SHA256,
+			LinkTarget: m.LinkTarget,
+		}
+		parent := path.Dir(p)
+		addDir(parent)
+
+		if existing, ok := idx.files[p]; ok {
+			// Replace a synthesized directory (or a duplicate entry).
+			siblings := idx.dirs[parent]
+			for i := range siblings {
+				if siblings[i].Path == existing.Path {
+					siblings[i] = entry
+				}
+			}
+		} else {
+			idx.dirs[parent] = append(idx.dirs[parent], entry)
+		}
+		idx.files[p] = entry
+		if entry.Type == "dir" {
+			if _, ok := idx.dirs[p]; !ok {
+				idx.dirs[p] = []IndexEntry{}
+			}
+		}
+	}
+
+	for _, children := range idx.dirs {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	}
+	return idx
+}
+
+// setManifest records a backup's manifest. The file indexes it feeds into,
+// the backup's own and those of incrementals taken on top of it, are
+// rebuilt on next use. The caller must hold dataMu.
+func setManifest(backupID string, manifest *Manifest) {
+	manifests[backupID] = manifest
+	for id := range fileIndexes {
+		for b := findBackup(id); b != nil; b = findBackup(b.ParentID) {
+			if b.ID == backupID {
+				delete(fileIndexes, id)
+				break
+			}
+		}
+	}
+	delete(fileIndexes, backupID)
+}
+
+// backupFileIndex returns the index of everything a backup holds as of when
+// it was taken; for an incremental that includes the files it inherits
+// from its chain. The caller must hold dataMu.
+func backupFileIndex(backup *Backup) (*fileIndex, error) {
+	if idx, ok := fileIndexes[backup.ID]; ok {
+		return idx, nil
+	}
+	manifest, err := mergedManifest(backup)
+	if err != nil {
+		return nil, err
+	}
+	idx := buildFileIndex(manifest)
+	fileIndexes[backup.ID] = idx
+	return idx, nil
+}
+
+// fileIndexError reports why a backup has no file index.
+func fileIndexError(w http.ResponseWriter, backupID string, err error) {
+	switch {
+	case err == errSealedManifest:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case manifests[backupID] == nil:
+		http.Error(w, "Backup has no file index", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// Browse handlers
+func listBackupFilesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+	q := r.URL.Query()
+
+	backup := findBackup(backupID)
+	if backup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	idx, err := backupFileIndex(backup)
+	if err != nil {
+		fileIndexError(w, backupID, err)
+		return
+	}
+
+	offset, limit := 0, defaultListLimit
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	dir := indexPath(q.Get("path"))
+	children, ok := idx.dirs[dir]
+	if !ok {
+		if _, isFile := idx.files[dir]; isFile {
+			http.Error(w, "Path is not a directory", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+
+	listing := FileListing{Path: dir, Entries: []IndexEntry{}, Total: len(children), Offset: offset, Limit: limit}
+	if offset < len(children) {
+		end := offset + limit
+		if end > len(children) {
+			end = len(children)
+		}
+		listing.Entries = children[offset:end]
+		if end < len(children) {
+			listing.NextOffset = &end
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
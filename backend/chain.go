@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Backup kinds. An incremental backup holds only the entries that changed
+// since its parent, plus the paths deleted since then; following ParentID
+// links always ends at a full backup.
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+)
+
+// ChainLink is one backup of an incremental chain.
+type ChainLink struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Timestamp time.Time `json:"timestamp"`
+	Status    string    `json:"status"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`
+}
+
+// BackupChain is the chain a backup depends on, oldest (the full) first,
+// and the incrementals taken on top of it.
+type BackupChain struct {
+	BackupID string      `json:"backupId"`
+	Chain    []ChainLink `json:"chain"`
+	Children []string    `json:"children"`
+}
+
+func backupKind(backup *Backup) string {
+	if backup.Kind == "" {
+		return BackupFull
+	}
+	return backup.Kind
+}
+
+// validateParent checks the chain fields of a backup being registered. The
+// caller must hold dataMu.
+func validateParent(backup *Backup) error {
+	switch backup.Kind {
+	case "":
+		backup.Kind = BackupFull
+		if backup.ParentID != "" {
+			backup.Kind = BackupIncremental
+		}
+	case BackupFull, BackupIncremental:
+	default:
+		return fmt.Errorf("kind must be %q or %q", BackupFull, BackupIncremental)
+	}
+	if backup.Kind == BackupFull {
+		if backup.ParentID != "" {
+			return fmt.Errorf("a full backup has no parent")
+		}
+		return nil
+	}
+	if backup.ParentID == "" {
+		return fmt.Errorf("an incremental backup needs a parentId")
+	}
+	parent := findBackup(backup.ParentID)
+	if parent == nil {
+		return fmt.Errorf("parent backup %s not found", backup.ParentID)
+	}
+	// The chain was consolidated; build on the synthetic full instead.
+	if parent.ConsolidatedInto != "" {
+		if synthetic := findBackup(parent.ConsolidatedInto); synthetic != nil {
+			backup.ParentID = synthetic.ID
+			parent = synthetic
+		}
+	}
+	if parent.DeviceID != backup.DeviceID {
+		return fmt.Errorf("parent backup %s belongs to another device", backup.ParentID)
+	}
+	if !parent.Timestamp.Before(backup.Timestamp) {
+		return fmt.Errorf("parent backup %s is not older than the backup", backup.ParentID)
+	}
+	return nil
+}
+
+// backupChain returns the backups a backup depends on, from its full
+// backup up to and including itself. The caller must hold dataMu.
+func backupChain(backup *Backup) ([]*Backup, error) {
+	chain := []*Backup{backup}
+	seen := map[string]bool{backup.ID: true}
+	for b := backup; b.ParentID != ""; {
+		parent := findBackup(b.ParentID)
+		if parent == nil {
+			return nil, fmt.Errorf("backup %s: parent %s is missing", b.ID, b.ParentID)
+		}
+		if seen[parent.ID] {
+			return nil, fmt.Errorf("backup %s: chain loops back to %s", b.ID, parent.ID)
+		}
+		seen[parent.ID] = true
+		chain = append(chain, parent)
+		b = parent
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// backupChildren returns the IDs of the incrementals taken directly on top
+// of a backup, oldest first. The caller must hold dataMu.
+func backupChildren(backupID string) []string {
+	children := []*Backup{}
+	for i := range backups {
+		if backups[i].ParentID == backupID {
+			children = append(children, &backups[i])
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Timestamp.Before(children[j].Timestamp) })
+	ids := []string{}
+	for _, child := range children {
+		ids = append(ids, child.ID)
+	}
+	return ids
+}
+
+// deletedPaths is the set of paths an incremental manifest deletes.
+type deletedPaths map[string]bool
+
+func manifestDeletions(manifest *Manifest) deletedPaths {
+	deleted := deletedPaths{}
+	for _, p := range manifest.Deleted {
+		deleted[strings.TrimSuffix(p, "/")] = true
+	}
+	return deleted
+}
+
+// covers reports whether p or a directory above it was deleted.
+func (deleted deletedPaths) covers(p string) bool {
+	if len(deleted) == 0 {
+		return false
+	}
+	for p = strings.TrimSuffix(p, "/"); p != "" && p != "."; {
+		if deleted[p] {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return false
+}
+
+// mergeManifest applies an incremental manifest on top of the merged
+// manifest of its parent: changed entries replace the parent's, new ones
+// are added and deleted paths (with anything under them) are dropped.
+func mergeManifest(base, delta *Manifest) *Manifest {
+	deleted := manifestDeletions(delta)
+	changed := map[string]ManifestEntry{}
+	for _, entry := range delta.Entries {
+		changed[entry.Path] = entry
+	}
+
+	merged := &Manifest{ArchiveSHA256: delta.ArchiveSHA256, Entries: []ManifestEntry{}}
+	for _, entry := range base.Entries {
+		if _, ok := changed[entry.Path]; ok || deleted.covers(entry.Path) {
+			continue
+		}
+		merged.Entries = append(merged.Entries, entry)
+	}
+	merged.Entries = append(merged.Entries, delta.Entries...)
+	return merged
+}
+
+// mergedManifest returns the full file list of a backup as of when it was
+// taken: its own manifest for a full backup, or the chain's manifests
+// merged in order for an incremental one. End-to-end encrypted backups have
+// no file list the server can read. The caller must hold dataMu.
+func mergedManifest(backup *Backup) (*Manifest, error) {
+	if backup.EncryptionKey != "" {
+		return nil, errSealedManifest
+	}
+	if backup.ParentID == "" {
+		manifest, ok := manifests[backup.ID]
+		if !ok {
+			return nil, fmt.Errorf("backup %s has no manifest", backup.ID)
+		}
+		return manifest, nil
+	}
+	chain, err := backupChain(backup)
+	if err != nil {
+		return nil, err
+	}
+	var merged *Manifest
+	for _, link := range chain {
+		manifest, ok := manifests[link.ID]
+		if !ok {
+			return nil, fmt.Errorf("backup %s has no manifest", link.ID)
+		}
+		if link.EncryptionKey != "" {
+			return nil, errSealedManifest
+		}
+		if merged == nil {
+			merged = manifest
+			continue
+		}
+		merged = mergeManifest(merged, manifest)
+	}
+	return merged, nil
+}
+
+// Chain handlers
+func getBackupChainHandler(w http.ResponseWriter, r *http.Request) {
+	backupID := mux.Vars(r)["backupId"]
+	backup := findBackup(backupID)
+	if backup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	chain, err := backupChain(backup)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	result := BackupChain{BackupID: backupID, Chain: []ChainLink{}, Children: backupChildren(backupID)}
+	for _, link := range chain {
+		result.Chain = append(result.Chain, ChainLink{
+			ID:        link.ID,
+			Kind:      backupKind(link),
+			Timestamp: link.Timestamp,
+			Status:    link.Status,
+			Files:     link.Files,
+			Size:      link.Size,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deduplicated archives are split into content-defined chunks (a gear
+// rolling hash picks the cut points, so an insertion only changes the
+// chunks around it) and each chunk is stored once per backend under a keyed
+// hash of its content. A backup is then just its list of chunks.
+//
+// Chunk ids and chunk encryption keys are derived from the device's data
+// key, so chunks only dedupe within a device: no device's data is shared
+// with, or can be matched against, another's.
+//
+// Agents write archives as a series of gzip members cut at content-defined
+// points of the tar stream (like gzip --rsyncable), so data that didn't
+// change compresses to the same bytes in every backup and dedupes here.
+// End-to-end encrypted archives never dedupe.
+//
+// Chunk indexes and reference counts are saved to chunks.json in the
+// archive directory after every change, so a restart neither orphans chunks
+// nor frees ones still in use.
+
+const (
+	chunkMinSize = 16 << 10
+	chunkAvgBits = 16 // 64 KiB average
+	chunkMaxSize = 256 << 10
+)
+
+// Cut-point masks test the top bits of the hash, which depend on the last 64
+// bytes. The stricter mask below the average size and the looser one above
+// it keep chunk sizes close to the average.
+const (
+	chunkMaskSmall = ^(^uint64(0) >> (chunkAvgBits + 2))
+	chunkMaskLarge = ^(^uint64(0) >> (chunkAvgBits - 2))
+)
+
+// chunkGear maps bytes to random-looking values. It must never change, or
+// new chunks would stop matching stored ones.
+var chunkGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return gear
+}()
+
+// chunkBoundary returns the length of the first chunk in data, which holds
+// at least chunkMaxSize bytes unless the input ends sooner.
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	var h uint64
+	for i := chunkMinSize - 64; i < n; i++ {
+		h = h<<1 + chunkGear[data[i]]
+		if i+1 < chunkMinSize {
+			continue
+		}
+		mask := chunkMaskLarge
+		if i+1 < 1<<chunkAvgBits {
+			mask = chunkMaskSmall
+		}
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && len(c.buf) < chunkMaxSize {
+		fill := make([]byte, chunkMaxSize-len(c.buf))
+		n, err := io.ReadFull(c.r, fill)
+		c.buf = append(c.buf, fill[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	cut := chunkBoundary(c.buf)
+	chunk := c.buf[:cut]
+	c.buf = append([]byte(nil), c.buf[cut:]...)
+	return chunk, nil
+}
+
+type chunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// chunkIndex lists the chunks of one backup's archive and the backend its
+// upload stored them on. NewChunks and NewBytes count what the upload
+// actually had to store.
+type chunkIndex struct {
+	Chunks    []chunkRef `json:"chunks"`
+	Storage   string     `json:"storage"`
+	Size      int64      `json:"size"`
+	NewChunks int        `json:"newChunks"`
+	NewBytes  int64      `json:"newBytes"`
+	StoredAt  time.Time  `json:"storedAt"`
+}
+
+var (
+	chunkMu      sync.Mutex
+	chunkIndexes = map[string]*chunkIndex{}
+	// References to each chunk per backend, keyed "<backend>/<chunk id>".
+	// A chunk object is deleted when its count drops to zero.
+	chunkRefs    = map[string]int{}
+	dedupEnabled = true
+	// Where chunkIndexes and chunkRefs are saved; empty until loaded.
+	chunkStatePath string
+)
+
+// chunkState is the saved form of chunkIndexes and chunkRefs.
+type chunkState struct {
+	Indexes map[string]*chunkIndex `json:"indexes"`
+	Refs    map[string]int         `json:"refs"`
+}
+
+func chunkObjectKey(id string) string {
+	return "chunks/" + id[:2] + "/" + id + ".chunk"
+}
+
+// chunkKeys derives a device's chunk id and chunk encryption keys from its
+// data key.
+func chunkKeys(deviceID string, create bool) ([]byte, []byte, error) {
+	key, err := deviceDataKey(deviceID, create)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hmacSHA256(key, "chunk-id"), hmacSHA256(key, "chunk-data"), nil
+}
+
+// loadChunkState reads the saved chunk indexes and reference counts.
+func loadChunkState(path string) error {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	chunkStatePath = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read chunk index: %s", err)
+	}
+	var state chunkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse chunk index: %s", err)
+	}
+	if state.Indexes != nil {
+		chunkIndexes = state.Indexes
+	}
+	if state.Refs != nil {
+		chunkRefs = state.Refs
+	}
+	return nil
+}
+
+// saveChunkState replaces the saved chunk state atomically. References on
+// backends that don't outlive the process are left out. The caller must
+// hold chunkMu.
+func saveChunkState() error {
+	if chunkStatePath == "" {
+		return nil
+	}
+	state := chunkState{Indexes: chunkIndexes, Refs: map[string]int{}}
+	for key, n := range chunkRefs {
+		name, _, _ := strings.Cut(key, "/")
+		if store, ok := storageBackends[name]; ok && isVolatile(store) {
+			continue
+		}
+		state.Refs[key] = n
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := chunkStatePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save chunk index: %s", err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, chunkStatePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save chunk index: %s", err)
+	}
+	return nil
+}
+
+// collectChunkGarbage drops the saved chunk indexes of backups the catalog
+// doesn't hold as chunked (it isn't saved, so after a restart that is all
+// of them) and deletes the chunks no remaining index lists, on every
+// backend. Chunks a remaining index lists keep their counts. It runs at
+// startup, once every backend is registered.
+func collectChunkGarbage() error {
+	dataMu.Lock()
+	live := map[string]bool{}
+	for _, backup := range backups {
+		if backup.Chunked {
+			live[backup.ID] = true
+		}
+	}
+	dataMu.Unlock()
+
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	inUse := map[string]bool{}
+	for id, index := range chunkIndexes {
+		if !live[id] {
+			delete(chunkIndexes, id)
+			continue
+		}
+		for _, ref := range index.Chunks {
+			inUse[ref.ID] = true
+		}
+	}
+	unused := map[string][]string{}
+	for key := range chunkRefs {
+		name, id, _ := strings.Cut(key, "/")
+		if _, ok := storageBackends[name]; !ok || inUse[id] {
+			continue
+		}
+		delete(chunkRefs, key)
+		unused[name] = append(unused[name], id)
+	}
+	if err := saveChunkState(); err != nil {
+		return err
+	}
+	var firstErr error
+	for name, ids := range unused {
+		for _, id := range ids {
+			if err := storageBackends[name].Delete(chunkObjectKey(id)); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		fmt.Printf("Released %d unreferenced chunks on %s\n", len(ids), name)
+	}
+	return firstErr
+}
+
+// persistChunkState saves the chunk state, logging rather than failing:
+// the change it records has already happened.
+func persistChunkState() {
+	if err := saveChunkState(); err != nil {
+		fmt.Printf("%s\n", err)
+	}
+}
+
+func chunkID(idKey, data []byte) string {
+	mac := hmac.New(sha256.New, idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// acquireChunk takes a reference to a chunk the backend already holds,
+// reporting false if it doesn't hold it.
+func acquireChunk(store Storage, id string) bool {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	key := store.Name() + "/" + id
+	if chunkRefs[key] > 0 {
+		chunkRefs[key]++
+		return true
+	}
+	return false
+}
+
+// addChunkRef records a reference to a chunk just written to a backend.
+func addChunkRef(store Storage, id string) {
+	chunkMu.Lock()
+	chunkRefs[store.Name()+"/"+id]++
+	chunkMu.Unlock()
+}
+
+// releaseChunks drops one reference per listed chunk and deletes the chunks
+// nobody references any more. The counts are saved before anything is
+// deleted, so a crash can leave an unused chunk behind but never a saved
+// reference to a deleted one. chunkMu is held across the deletes so a
+// concurrent upload can't reuse a chunk that is about to go.
+func releaseChunks(store Storage, chunks []chunkRef) error {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	unused := []string{}
+	for _, ref := range chunks {
+		key := store.Name() + "/" + ref.ID
+		if chunkRefs[key]--; chunkRefs[key] > 0 {
+			continue
+		}
+		delete(chunkRefs, key)
+		unused = append(unused, ref.ID)
+	}
+	if err := saveChunkState(); err != nil {
+		return err
+	}
+	var firstErr error
+	for _, id := range unused {
+		if err := store.Delete(chunkObjectKey(id)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// storeChunks splits src into chunks and writes the ones the backend
+// doesn't hold yet, under the device's chunk keys.
+func storeChunks(store Storage, deviceID string, src io.Reader) (*chunkIndex, error) {
+	idKey, encKey, err := chunkKeys(deviceID, true)
+	if err != nil {
+		return nil, err
+	}
+	index := &chunkIndex{Chunks: []chunkRef{}, Storage: store.Name(), StoredAt: time.Now()}
+	fail := func(err error) (*chunkIndex, error) {
+		releaseChunks(store, index.Chunks)
+		return nil, err
+	}
+
+	c := &chunker{r: src}
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		ref := chunkRef{ID: chunkID(idKey, data), Size: int64(len(data))}
+		if !acquireChunk(store, ref.ID) {
+			var buf bytes.Buffer
+			ew, err := newEncryptingWriter(&buf, encKey)
+			if err != nil {
+				return fail(err)
+			}
+			ew.Write(data)
+			if err := ew.Close(); err != nil {
+				return fail(err)
+			}
+			if err := store.Put(chunkObjectKey(ref.ID), &buf, int64(buf.Len())); err != nil {
+				return fail(fmt.Errorf("failed to store chunk: %s", err))
+			}
+			addChunkRef(store, ref.ID)
+			index.NewChunks++
+			index.NewBytes += ref.Size
+		}
+		index.Chunks = append(index.Chunks, ref)
+		index.Size += ref.Size
+	}
+	return index, nil
+}
+
+// storeChunkedArchive stores src deduplicated on the active backend and
+// records it on backup, releasing the chunks of any earlier upload of the
+// same backup once the new ones are referenced.
+func storeChunkedArchive(backup *Backup, src io.Reader) (int64, error) {
+	store := activeStorage
+	index, err := storeChunks(store, backup.DeviceID, src)
+	if err != nil {
+		return 0, err
+	}
+
+	chunkMu.Lock()
+	old := chunkIndexes[backup.ID]
+	chunkIndexes[backup.ID] = index
+	persistChunkState()
+	chunkMu.Unlock()
+	if old != nil {
+		if oldStore, ok := storageBackends[old.Storage]; ok {
+			releaseChunks(oldStore, old.Chunks)
+		}
+	}
+
+	backup.Storage = store.Name()
+	backup.Chunked = true
+	return index.Size, nil
+}
+
+func backupChunkIndex(backupID string) *chunkIndex {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	return chunkIndexes[backupID]
+}
+
+// forgetChunkIndex drops a backup's chunk list once no backend holds it.
+func forgetChunkIndex(backupID string) {
+	chunkMu.Lock()
+	if _, ok := chunkIndexes[backupID]; ok {
+		delete(chunkIndexes, backupID)
+		persistChunkState()
+	}
+	chunkMu.Unlock()
+}
+
+// hasChunks reports whether the backend holds every chunk of a backup.
+func hasChunks(backup *Backup, store Storage) bool {
+	index := backupChunkIndex(backup.ID)
+	if index == nil {
+		return false
+	}
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+	for _, ref := range index.Chunks {
+		if chunkRefs[store.Name()+"/"+ref.ID] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// copyChunks references every listed chunk on to, copying the ones it
+// doesn't hold yet from from. Chunks are copied as ciphertext.
+func copyChunks(chunks []chunkRef, from, to Storage) error {
+	done := []chunkRef{}
+	for _, ref := range chunks {
+		if !acquireChunk(to, ref.ID) {
+			key := chunkObjectKey(ref.ID)
+			rc, err := from.Get(key, 0, -1)
+			if err != nil {
+				releaseChunks(to, done)
+				return fmt.Errorf("failed to read chunk: %s", err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err == nil {
+				err = to.Put(key, bytes.NewReader(data), int64(len(data)))
+			}
+			if err != nil {
+				releaseChunks(to, done)
+				return fmt.Errorf("failed to copy chunk: %s", err)
+			}
+			addChunkRef(to, ref.ID)
+		}
+		done = append(done, ref)
+	}
+	chunkMu.Lock()
+	persistChunkState()
+	chunkMu.Unlock()
+	return nil
+}
+
+// readChunk fetches and decrypts a chunk, checking it against its id so a
+// chunk can't be swapped for another.
+func readChunk(store Storage, id string, idKey, encKey []byte) ([]byte, error) {
+	rc, err := store.Get(chunkObjectKey(id), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	dr, err := newDecryptingReader(bytes.NewReader(sealed), int64(len(sealed)), encKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, err
+	}
+	if chunkID(idKey, data) != id {
+		return nil, errors.New("chunk content does not match its id")
+	}
+	return data, nil
+}
+
+// chunkedReader is a seekable view of a chunked archive. It keeps the
+// current chunk decrypted, so sequential reads fetch each chunk once.
+type chunkedReader struct {
+	store   Storage
+	idKey   []byte
+	encKey  []byte
+	chunks  []chunkRef
+	offsets []int64
+	size    int64
+	pos     int64
+	cur     int
+	data    []byte
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > c.pos }) - 1
+	if i != c.cur {
+		data, err := readChunk(c.store, c.chunks[i].ID, c.idKey, c.encKey)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read chunk %s: %s", c.chunks[i].ID, err)
+		}
+		if int64(len(data)) != c.chunks[i].Size {
+			return 0, fmt.Errorf("chunk %s has %d bytes, expected %d", c.chunks[i].ID, len(data), c.chunks[i].Size)
+		}
+		c.cur, c.data = i, data
+	}
+	n := copy(p, c.data[c.pos-c.offsets[i]:])
+	c.pos += int64(n)
+	return n, nil
+}
+
+func (c *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek position")
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+// openChunkedArchive returns a reader over the copy of a chunked archive
+// held by store.
+func openChunkedArchive(backup *Backup, store Storage) (*archiveReader, error) {
+	index := backupChunkIndex(backup.ID)
+	if index == nil || !hasChunks(backup, store) {
+		return nil, ErrObjectNotFound
+	}
+	idKey, encKey, err := chunkKeys(backup.DeviceID, false)
+	if err != nil {
+		return nil, err
+	}
+	reader := &chunkedReader{store: store, idKey: idKey, encKey: encKey, chunks: index.Chunks, size: index.Size, cur: -1}
+	var off int64
+	for _, ref := range index.Chunks {
+		reader.offsets = append(reader.offsets, off)
+		off += ref.Size
+	}
+	return &archiveReader{ReadSeeker: reader, modTime: index.StoredAt}, nil
+}
+
+// DedupStats compares the archive bytes of a set of chunked backups with
+// the unique chunk bytes they need. Devices never share chunks, so the
+// fleet figures are the sums of the device ones.
+type DedupStats struct {
+	DeviceID     string  `json:"deviceId,omitempty"`
+	DeviceName   string  `json:"deviceName,omitempty"`
+	Backups      int     `json:"backups"`
+	LogicalBytes int64   `json:"logicalBytes"`
+	UniqueBytes  int64   `json:"uniqueBytes"`
+	Chunks       int     `json:"chunks"`
+	Ratio        float64 `json:"ratio"`
+}
+
+func (s *DedupStats) add(index *chunkIndex, seen map[string]bool) {
+	s.Backups++
+	s.LogicalBytes += index.Size
+	for _, ref := range index.Chunks {
+		if !seen[ref.ID] {
+			seen[ref.ID] = true
+			s.Chunks++
+			s.UniqueBytes += ref.Size
+		}
+	}
+	if s.UniqueBytes > 0 {
+		s.Ratio = float64(s.LogicalBytes) / float64(s.UniqueBytes)
+	}
+}
+
+// Dedup handlers
+func getDedupStatsHandler(w http.ResponseWriter, r *http.Request) {
+	chunkMu.Lock()
+	defer chunkMu.Unlock()
+
+	fleet := DedupStats{}
+	fleetSeen := map[string]bool{}
+	perDevice := []DedupStats{}
+	for _, device := range devices {
+		stats := DedupStats{DeviceID: device.ID, DeviceName: device.Name}
+		seen := map[string]bool{}
+		for _, backup := range backups {
+			index := chunkIndexes[backup.ID]
+			if backup.DeviceID != device.ID || !backup.Chunked || index == nil {
+				continue
+			}
+			stats.add(index, seen)
+			fleet.add(index, fleetSeen)
+		}
+		perDevice = append(perDevice, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": dedupEnabled,
+		"fleet":   fleet,
+		"devices": perDevice,
+	})
+}
+
+func getBackupChunksHandler(w http.ResponseWriter, r *http.Request) {
+	backupID := mux.Vars(r)["backupId"]
+	backup := findBackup(backupID)
+	if backup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	index := backupChunkIndex(backupID)
+	if !backup.Chunked || index == nil {
+		http.Error(w, "Backup is not stored deduplicated", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Archives are stored encrypted at rest. Every device has its own 256-bit
+// data key; data keys are wrapped (AES-GCM) by a master key and kept in a
+// key store next to the archives. Rotating the master key only rewraps the
+// data keys, the archive data itself is never re-encrypted.
+//
+// Archive format: a fixed header followed by fixed-size plaintext segments,
+// each sealed independently with AES-256-GCM. Sealing per segment keeps
+// random access (and therefore range requests) cheap; the header and a
+// final-segment flag are bound into every segment's additional data so
+// segments can't be reordered, swapped between archives or truncated.
+
+const (
+	archiveMagic       = "IHHENC01"
+	archiveSegmentSize = 64 * 1024
+	archiveHeaderSize  = len(archiveMagic) + 8 + 4
+	archiveTagSize     = 16
+)
+
+// KeyStore holds the per-device data keys, and the key signing the audit
+// log, wrapped by the master key.
+type KeyStore struct {
+	MasterKeyID string            `json:"masterKeyId"`
+	DeviceKeys  map[string]string `json:"deviceKeys"`
+	AuditKey    string            `json:"auditKey,omitempty"`
+}
+
+var (
+	keyMu     sync.Mutex
+	masterKey []byte
+	keyStore  KeyStore
+	keyPath   string
+	// Held for as long as the server runs, see lockKeyStore.
+	keyLock *os.File
+)
+
+var errKeyStoreLocked = errors.New("key store is in use by another process (a running server or a key rotation)")
+
+// parseKey accepts a 32-byte key encoded as base64 or hex.
+func parseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes encoded as base64 or hex")
+}
+
+// loadMasterKey reads the master key from BACKUP_MASTER_KEY or the file named
+// by BACKUP_MASTER_KEY_FILE. It returns nil if neither is set.
+func loadMasterKey() ([]byte, error) {
+	if v := os.Getenv("BACKUP_MASTER_KEY"); v != "" {
+		return parseKey(v)
+	}
+	if path := os.Getenv("BACKUP_MASTER_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %s", err)
+		}
+		return parseKey(string(data))
+	}
+	return nil, nil
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func readKeyStore(path string) (KeyStore, error) {
+	ks := KeyStore{DeviceKeys: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return ks, fmt.Errorf("failed to read key store: %s", err)
+	}
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return ks, fmt.Errorf("failed to parse key store: %s", err)
+	}
+	if ks.DeviceKeys == nil {
+		ks.DeviceKeys = map[string]string{}
+	}
+	return ks, nil
+}
+
+// writeKeyStore replaces the key store atomically so a crash can never leave
+// a half-written file behind (which would make every archive unreadable).
+func writeKeyStore(path string, ks KeyStore) error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write key store: %s", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write key store: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write key store: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write key store: %s", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// initKeyStore loads the master key and key store. Without a master key the
+// server still runs, but refuses to accept archive uploads.
+func initKeyStore(dir string) error {
+	key, err := loadMasterKey()
+	if err != nil {
+		return err
+	}
+	if keyLock, err = lockKeyStore(dir); err != nil {
+		return err
+	}
+	keyPath = filepath.Join(dir, "keys.json")
+	ks, err := readKeyStore(keyPath)
+	if err != nil {
+		return err
+	}
+	if key != nil && ks.MasterKeyID != "" && ks.MasterKeyID != keyID(key) {
+		return fmt.Errorf("master key %s does not match key store (wrapped with %s)", keyID(key), ks.MasterKeyID)
+	}
+	masterKey = key
+	keyStore = ks
+	return nil
+}
+
+func wrapKey(kek, key []byte) (string, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+func unwrapKey(kek []byte, wrapped string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptionConfigured() bool {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	return masterKey != nil
+}
+
+// deviceDataKey returns the device's data key, generating and persisting a
+// new one on first use when create is set.
+func deviceDataKey(deviceID string, create bool) ([]byte, error) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	if masterKey == nil {
+		return nil, errors.New("archive encryption is not configured")
+	}
+	if wrapped, ok := keyStore.DeviceKeys[deviceID]; ok {
+		key, err := unwrapKey(masterKey, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key for device %s: %s", deviceID, err)
+		}
+		return key, nil
+	}
+	if !create {
+		return nil, fmt.Errorf("no data key for device %s", deviceID)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapKey(masterKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ks := KeyStore{MasterKeyID: keyID(masterKey), DeviceKeys: map[string]string{deviceID: wrapped}, AuditKey: keyStore.AuditKey}
+	for id, w := range keyStore.DeviceKeys {
+		ks.DeviceKeys[id] = w
+	}
+	if err := writeKeyStore(keyPath, ks); err != nil {
+		return nil, err
+	}
+	keyStore = ks
+	return key, nil
+}
+
+// auditDataKey returns the key signing the audit log, generating and
+// persisting a random one on first use. It is nil without a master key.
+func auditDataKey() ([]byte, error) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	if masterKey == nil {
+		return nil, nil
+	}
+	if keyStore.AuditKey != "" {
+		key, err := unwrapKey(masterKey, keyStore.AuditKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap audit key: %s", err)
+		}
+		return key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapKey(masterKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ks := KeyStore{MasterKeyID: keyID(masterKey), DeviceKeys: keyStore.DeviceKeys, AuditKey: wrapped}
+	if err := writeKeyStore(keyPath, ks); err != nil {
+		return nil, err
+	}
+	keyStore = ks
+	return key, nil
+}
+
+func segmentAAD(header []byte, final bool) []byte {
+	aad := make([]byte, len(header)+1)
+	copy(aad, header)
+	if final {
+		aad[len(header)] = 1
+	}
+	return aad
+}
+
+func segmentNonce(header []byte, index uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(archiveMagic):len(archiveMagic)+8])
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return nonce
+}
+
+// encryptingWriter seals everything written to it into the archive format.
+// Close must be called to write the final segment.
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint32
+}
+
+func newEncryptingWriter(w io.Writer, key []byte) (*encryptingWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, archiveHeaderSize)
+	copy(header, archiveMagic)
+	if _, err := rand.Read(header[len(archiveMagic) : len(archiveMagic)+8]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[len(archiveMagic)+8:], archiveSegmentSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, archiveSegmentSize)}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Hold back a full segment until more data arrives: only Close
+		// knows which segment is the final one.
+		if len(e.buf) == archiveSegmentSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):archiveSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.header, e.index), e.buf, segmentAAD(e.header, final))
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.flush(true)
+}
+
+// decryptingReader gives seekable plaintext access to an encrypted archive.
+type decryptingReader struct {
+	r        io.ReaderAt
+	aead     cipher.AEAD
+	header   []byte
+	segments int64
+	size     int64
+	pos      int64
+	cached   int64
+	plain    []byte
+}
+
+func newDecryptingReader(r io.ReaderAt, encryptedSize int64, key []byte) (*decryptingReader, error) {
+	header := make([]byte, archiveHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %s", err)
+	}
+	if string(header[:len(archiveMagic)]) != archiveMagic {
+		return nil, errors.New("not an encrypted archive")
+	}
+	if binary.BigEndian.Uint32(header[len(archiveMagic)+8:]) != archiveSegmentSize {
+		return nil, errors.New("unsupported archive segment size")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := encryptedSize - int64(archiveHeaderSize)
+	segments := (body + archiveSegmentSize + archiveTagSize - 1) / (archiveSegmentSize + archiveTagSize)
+	if segments == 0 || body-segments*archiveTagSize < 0 {
+		return nil, errors.New("archive is truncated")
+	}
+	return &decryptingReader{
+		r:        r,
+		aead:     aead,
+		header:   header,
+		segments: segments,
+		size:     body - segments*archiveTagSize,
+		cached:   -1,
+	}, nil
+}
+
+// Size returns the plaintext size of the archive.
+func (d *decryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptingReader) segment(index int64) ([]byte, error) {
+	if index == d.cached {
+		return d.plain, nil
+	}
+	off := int64(archiveHeaderSize) + index*(archiveSegmentSize+archiveTagSize)
+	n := int64(archiveSegmentSize + archiveTagSize)
+	if index == d.segments-1 {
+		n = int64(archiveHeaderSize) + d.size + d.segments*archiveTagSize - off
+	}
+	sealed := make([]byte, n)
+	if _, err := d.r.ReadAt(sealed, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	plain, err := d.aead.Open(nil, segmentNonce(d.header, uint32(index)), sealed, segmentAAD(d.header, index == d.segments-1))
+	if err != nil {
+		return nil, fmt.Errorf("archive segment %d failed authentication", index)
+	}
+	d.cached = index
+	d.plain = plain
+	return plain, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	plain, err := d.segment(d.pos / archiveSegmentSize)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, plain[d.pos%archiveSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// rotateMasterKeyCommand rewraps every device data key, and the audit key,
+// under a new master key. Usage: server rotate-master-key -new-key-file <path>
+//
+// The server must be stopped first: it keeps the key store in memory and
+// adds device keys to it, so it holds the key store lock while running.
+func rotateMasterKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("rotate-master-key", flag.ExitOnError)
+	dir := fs.String("archive-dir", getArchiveDir(), "Directory holding archives and the key store")
+	newKeyFile := fs.String("new-key-file", "", "File containing the new master key (base64 or hex)")
+	fs.Parse(args)
+
+	if *newKeyFile == "" {
+		return errors.New("-new-key-file is required")
+	}
+	oldKey, err := loadMasterKey()
+	if err != nil {
+		return err
+	}
+	if oldKey == nil {
+		return errors.New("current master key must be set via BACKUP_MASTER_KEY or BACKUP_MASTER_KEY_FILE")
+	}
+	data, err := os.ReadFile(*newKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read new master key: %s", err)
+	}
+	newKey, err := parseKey(string(data))
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockKeyStore(*dir)
+	if err == errKeyStoreLocked {
+		return errors.New("the key store is in use; stop the server before rotating the master key")
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	path := filepath.Join(*dir, "keys.json")
+	ks, err := readKeyStore(path)
+	if err != nil {
+		return err
+	}
+	if ks.MasterKeyID != "" && ks.MasterKeyID != keyID(oldKey) {
+		return fmt.Errorf("current master key %s does not match key store (wrapped with %s)", keyID(oldKey), ks.MasterKeyID)
+	}
+
+	rotated := KeyStore{MasterKeyID: keyID(newKey), DeviceKeys: map[string]string{}}
+	for deviceID, wrapped := range ks.DeviceKeys {
+		key, err := unwrapKey(oldKey, wrapped)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap data key for device %s: %s", deviceID, err)
+		}
+		if rotated.DeviceKeys[deviceID], err = wrapKey(newKey, key); err != nil {
+			return err
+		}
+	}
+	if ks.AuditKey != "" {
+		key, err := unwrapKey(oldKey, ks.AuditKey)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap audit key: %s", err)
+		}
+		if rotated.AuditKey, err = wrapKey(newKey, key); err != nil {
+			return err
+		}
+	}
+	if err := writeKeyStore(path, rotated); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rewrapped %d device keys: master key %s -> %s\n", len(rotated.DeviceKeys), keyID(oldKey), rotated.MasterKeyID)
+	fmt.Println("Update BACKUP_MASTER_KEY / BACKUP_MASTER_KEY_FILE before restarting the server.")
+	return nil
+}
+
+// generateMasterKeyCommand prints a fresh random master key.
+func generateMasterKeyCommand(args []string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdh"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -23,6 +24,18 @@ type Config struct {
 	BackupDir     string `json:"backupDir"`
 	LocalStorageDir string `json:"localStorageDir"`
 	IntervalMinutes int    `json:"intervalMinutes"`
+	// End-to-end encryption: archives are encrypted to this X25519 public
+	// key before leaving the device; restores need the matching identity.
+	RecipientPublicKey string `json:"recipientPublicKey,omitempty"`
+	IdentityFile       string `json:"identityFile,omitempty"`
+	// Incremental backups archive only what changed since the last one; a
+	// full backup is still taken every FullBackupDays.
+	Incremental    bool `json:"incremental,omitempty"`
+	FullBackupDays int  `json:"fullBackupDays,omitempty"`
+	// Absolute paths to back up, and patterns to leave out in .backupignore
+	// syntax; .backupignore files in backed-up directories add to them.
+	IncludePaths    []string `json:"includePaths,omitempty"`
+	ExcludePatterns []string `json:"excludePatterns,omitempty"`
 }
 
 // Status response
@@ -32,10 +45,17 @@ type StatusResponse struct {
 
 var (
 	configFile = flag.String("config", "config.json", "Path to configuration file")
+	genKeyFile = flag.String("genkey", "", "Generate an X25519 identity at this path, print its public key and exit")
+	restoreID  = flag.String("restore", "", "Restore the given backup from the server and exit")
+	restoreAtTime = flag.String("restore-at", "", "Restore the device as it was at this RFC 3339 time and exit")
+	restoreDir = flag.String("restore-dir", "/", "Directory to extract restored files into")
 	config     Config
 	logger     *log.Logger
 )
 
+// How many times a restore download is retried before giving up
+const downloadAttempts = 5
+
 func init() {
 	// Set up logging
 	logFile, err := os.OpenFile("agent.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
@@ -47,8 +67,6 @@ func init() {
 }
 
 func loadConfig() error {
-	flag.Parse()
-	
 	data, err := os.ReadFile(*configFile)
 	if err != nil {
 		return fmt.Errorf("failed to read config file: %s", err)
@@ -79,6 +97,17 @@ func loadConfig() error {
 	if config.IntervalMinutes <= 0 {
 		config.IntervalMinutes = 60 // Default to hourly
 	}
+	if config.FullBackupDays <= 0 {
+		config.FullBackupDays = 7 // Default to a weekly full backup
+	}
+	if len(config.IncludePaths) == 0 {
+		config.IncludePaths = defaultIncludePaths
+	}
+	if config.RecipientPublicKey != "" {
+		if _, err := parseX25519Key(config.RecipientPublicKey); err != nil {
+			return fmt.Errorf("invalid recipientPublicKey: %s", err)
+		}
+	}
 	
 	return nil
 }
@@ -152,53 +181,107 @@ func pingServer() bool {
 	return resp.StatusCode == http.StatusOK
 }
 
-func createBackup() (string, int64, int, error) {
+func createBackup(plan *backupPlan) (string, int64, *Manifest, error) {
 	timestamp := time.Now().Format("20060102-150405")
 	backupID := fmt.Sprintf("backup-%s-%s", config.DeviceID, timestamp)
 	backupPath := filepath.Join(config.LocalStorageDir, backupID+".tar.gz")
 	
-	// Create tar.gz backup of important directories
-	// In a real implementation, this would be more sophisticated and configurable
-	cmd := exec.Command("tar", "-czf", backupPath, "/etc", "/var/log")
+	if plan.kind == backupFull && len(plan.paths) == 0 {
+		return "", 0, nil, fmt.Errorf("nothing to back up: no include path could be read")
+	}
+	
+	logger.Printf("Creating %s backup: %s", plan.kind, backupPath)
 	
-	logger.Printf("Creating backup: %s", backupPath)
+	// Archive the scanned entries, building the manifest as they are written.
+	// Files that can't be read are left out and retried on the next run.
+	entries, skipped, err := writeArchive(backupPath, plan.paths, plan.warn)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	plan.skipped = skipped
 	
-	if err := cmd.Run(); err != nil {
-		return "", 0, 0, fmt.Errorf("backup command failed: %s", err)
+	if config.RecipientPublicKey != "" {
+		if _, err = encryptBackupFile(backupPath); err != nil {
+			return backupID, 0, nil, err
+		}
+		backupPath = backupFilePath(backupID)
 	}
 	
 	// Get backup info
 	fileInfo, err := os.Stat(backupPath)
 	if err != nil {
-		return backupID, 0, 0, fmt.Errorf("failed to get backup file info: %s", err)
+		return backupID, 0, nil, fmt.Errorf("failed to get backup file info: %s", err)
 	}
 	
 	size := fileInfo.Size()
 	
-	// Count files in the archive
-	listCmd := exec.Command("tar", "-tzf", backupPath)
-	listOutput, err := listCmd.Output()
+	archiveHash, err := fileSHA256(backupPath)
+	if err != nil {
+		return backupID, size, nil, fmt.Errorf("failed to hash backup: %s", err)
+	}
+	manifest := &Manifest{ArchiveSHA256: archiveHash, Entries: entries, Deleted: plan.deleted}
+	
+	logger.Printf("Backup created: %s (size: %d bytes, files: %d, deleted: %d)", backupPath, size, len(entries), len(plan.deleted))
+	
+	return backupID, size, manifest, nil
+}
+
+// backupFilePath returns where the archive for backupID is kept locally.
+// End-to-end encrypted archives never exist in plaintext once created.
+func backupFilePath(backupID string) string {
+	if config.RecipientPublicKey != "" {
+		return filepath.Join(config.LocalStorageDir, backupID+".tar.gz.e2e")
+	}
+	return filepath.Join(config.LocalStorageDir, backupID+".tar.gz")
+}
+
+// encryptBackupFile encrypts a plaintext archive to the configured recipient
+// and removes the plaintext, returning the encrypted size.
+func encryptBackupFile(plainPath string) (int64, error) {
+	recipient, err := parseX25519Key(config.RecipientPublicKey)
 	if err != nil {
-		return backupID, size, 0, fmt.Errorf("failed to list backup contents: %s", err)
+		return 0, err
 	}
+	encPath := strings.TrimSuffix(plainPath, ".tar.gz") + ".tar.gz.e2e"
 	
-	fileCount := len(strings.Split(string(listOutput), "\n")) - 1
+	src, err := os.Open(plainPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup for encryption: %s", err)
+	}
+	defer os.Remove(plainPath)
+	defer src.Close()
 	
-	logger.Printf("Backup created: %s (size: %d bytes, files: %d)", backupPath, size, fileCount)
+	dst, err := os.OpenFile(encPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create encrypted backup: %s", err)
+	}
+	if err := encryptStream(dst, src, recipient); err != nil {
+		dst.Close()
+		os.Remove(encPath)
+		return 0, fmt.Errorf("failed to encrypt backup: %s", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(encPath)
+		return 0, fmt.Errorf("failed to encrypt backup: %s", err)
+	}
 	
-	return backupID, size, fileCount, nil
+	info, err := os.Stat(encPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get backup file info: %s", err)
+	}
+	return info.Size(), nil
 }
 
-func uploadBackup(backupID string, size int64, fileCount int) error {
-	backupPath := filepath.Join(config.LocalStorageDir, backupID+".tar.gz")
+func uploadBackup(backupID string, size int64, manifest *Manifest, plan *backupPlan) error {
+	backupPath := backupFilePath(backupID)
 	
 	// Check if file exists
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
 		return fmt.Errorf("backup file not found: %s", backupPath)
 	}
 	
-	// In a real implementation, we would upload the actual file here
-	// For this example, we'll just notify the server about the backup
+	// Register the backup with the server, then upload the archive itself.
+	// The server marks the backup completed once the archive is stored.
 	
 	type BackupNotification struct {
 		ID         string    `json:"id"`
@@ -211,6 +294,24 @@ func uploadBackup(backupID string, size int64, fileCount int) error {
 		Type       string    `json:"type"`
 		Version    string    `json:"version"`
 		Files      int       `json:"files"`
+		Kind       string    `json:"kind"`
+		ParentID   string    `json:"parentId,omitempty"`
+		Warnings   []string  `json:"warnings,omitempty"`
+		EncryptionKey string `json:"encryptionKey,omitempty"`
+		ArchiveSHA256 string `json:"archiveSha256"`
+		Manifest      *Manifest `json:"manifest"`
+	}
+	
+	encryptionKey := ""
+	sent := manifest
+	if config.RecipientPublicKey != "" {
+		recipient, _ := parseX25519Key(config.RecipientPublicKey)
+		encryptionKey = keyFingerprint(recipient)
+		// The server only gets to see ciphertext, file list included.
+		var err error
+		if sent, err = sealManifest(manifest, recipient); err != nil {
+			return err
+		}
 	}
 	
 	notification := BackupNotification{
@@ -219,11 +320,17 @@ func uploadBackup(backupID string, size int64, fileCount int) error {
 		DeviceName: config.DeviceName,
 		Timestamp:  time.Now(),
 		Size:       size,
-		Status:     "completed",
-		Location:   "both", // Assuming successful upload to server
+		Status:     "in-progress",
+		Location:   "local",
 		Type:       "scheduled",
 		Version:    "1.0.0",
-		Files:      fileCount,
+		Files:      len(manifest.Entries),
+		Kind:       plan.kind,
+		ParentID:   plan.parentID,
+		Warnings:   plan.warnings,
+		EncryptionKey: encryptionKey,
+		ArchiveSHA256: manifest.ArchiveSHA256,
+		Manifest:      sent,
 	}
 	
 	jsonData, err := json.Marshal(notification)
@@ -231,25 +338,255 @@ func uploadBackup(backupID string, size int64, fileCount int) error {
 		return fmt.Errorf("failed to marshal backup notification: %s", err)
 	}
 	
-	resp, err := http.Post(
-		fmt.Sprintf("%s/api/backups", config.ServerURL),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
-	if err != nil {
+	if err := serverRequest("POST", "/api/backups", "application/json", bytes.NewBuffer(jsonData)); err != nil {
 		return fmt.Errorf("failed to send backup notification: %s", err)
 	}
+	
+	archive, err := os.Open(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %s", err)
+	}
+	defer archive.Close()
+	
+	if err := serverRequest("PUT", fmt.Sprintf("/api/backups/%s/archive", backupID), "application/gzip", archive); err != nil {
+		return fmt.Errorf("failed to upload backup archive: %s", err)
+	}
+	
+	logger.Printf("Backup %s uploaded to server", backupID)
+	return nil
+}
+
+// serverRequest sends a request to the backup server, identifying this
+// device, and fails on any non-200 response.
+func serverRequest(method, path, contentType string, body io.Reader) error {
+	req, err := http.NewRequest(method, config.ServerURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Device-ID", config.DeviceID)
+	if f, ok := body.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			req.ContentLength = info.Size()
+		}
+	}
+	
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 	
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned error: %s", string(body))
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned error: %s", strings.TrimSpace(string(respBody)))
 	}
+	return nil
+}
+
+// downloadArchive fetches a backup archive into path. A partial file left by
+// an earlier attempt is resumed with a Range request; If-Range makes the
+// server send the whole archive instead if it no longer matches etag.
+func downloadArchive(backupID, path, etag string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create download file: %s", err)
+	}
+	defer f.Close()
 	
-	logger.Printf("Backup %s uploaded to server", backupID)
+	var lastErr error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/backups/%s/archive", config.ServerURL, backupID), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Device-ID", config.DeviceID)
+		if offset > 0 && etag != "" {
+			logger.Printf("Resuming download of backup %s at byte %d", backupID, offset)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", etag)
+		}
+		
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+			// The file is already as long as the archive, e.g. left over
+			// from a restore whose extraction failed. Keep it if it's the
+			// archive, otherwise start over.
+			resp.Body.Close()
+			if got, err := fileSHA256(path); err == nil && got == strings.Trim(etag, `"`) {
+				lastErr = nil
+				break
+			}
+			logger.Printf("Discarding stale download of backup %s", backupID)
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			lastErr = fmt.Errorf("stale download discarded")
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// Full archive: discard anything downloaded before.
+			if err := f.Truncate(0); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		default:
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("server returned error: %s", strings.TrimSpace(string(body)))
+		}
+		if tag := resp.Header.Get("ETag"); tag != "" {
+			etag = tag
+		}
+		_, err = io.Copy(f, resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			lastErr = nil
+			break
+		}
+		lastErr = err
+		logger.Printf("Download of backup %s interrupted: %s", backupID, err)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to download archive: %s", lastErr)
+	}
+	
+	if want := strings.Trim(etag, `"`); want != "" {
+		got, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			f.Truncate(0)
+			return fmt.Errorf("downloaded archive hash %s does not match %s", got, want)
+		}
+	}
+	return nil
+}
+
+// restoreBackup downloads a backup from the server, decrypting it locally if
+// it was end-to-end encrypted, and extracts it into dir. The download is
+// kept in the backup directory until extraction succeeds, so an interrupted
+// restore picks up where it left off.
+func restoreBackup(backupID, dir string) error {
+	var backup struct {
+		DeviceID      string `json:"deviceId"`
+		EncryptionKey string `json:"encryptionKey"`
+		ArchiveSHA256 string `json:"archiveSha256"`
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/api/backups/%s", config.ServerURL, backupID))
+	if err != nil {
+		return fmt.Errorf("failed to look up backup: %s", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&backup)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil {
+		return fmt.Errorf("backup %s not found on server", backupID)
+	}
+	
+	var identity *ecdh.PrivateKey
+	if backup.EncryptionKey != "" {
+		if config.IdentityFile == "" {
+			return fmt.Errorf("backup is encrypted to %s but no identityFile is configured", backup.EncryptionKey)
+		}
+		if identity, err = loadIdentity(config.IdentityFile); err != nil {
+			return err
+		}
+		if fp := keyFingerprint(identity.PublicKey().Bytes()); fp != backup.EncryptionKey {
+			return fmt.Errorf("backup is encrypted to %s, identity is %s", backup.EncryptionKey, fp)
+		}
+	}
+	
+	if err := os.MkdirAll(config.BackupDir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %s", err)
+	}
+	downloadPath := filepath.Join(config.BackupDir, backupID+".download")
+	etag := ""
+	if backup.ArchiveSHA256 != "" {
+		etag = `"` + backup.ArchiveSHA256 + `"`
+	}
+	logger.Printf("Downloading backup %s", backupID)
+	if err := downloadArchive(backupID, downloadPath, etag); err != nil {
+		return err
+	}
+	archive, err := os.Open(downloadPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create restore directory: %s", err)
+	}
+	cmd := exec.Command("tar", "-xzf", "-", "-C", dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start tar: %s", err)
+	}
+	
+	logger.Printf("Restoring backup %s into %s", backupID, dir)
+	if identity != nil {
+		err = decryptStream(stdin, archive, identity)
+	} else {
+		_, err = io.Copy(stdin, archive)
+	}
+	stdin.Close()
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("restore command failed: %s", waitErr)
+	}
+	if err != nil {
+		return err
+	}
+	
+	os.Remove(downloadPath)
+	logger.Printf("Backup %s restored", backupID)
 	return nil
 }
 
+// reportRestore tells the server how a restore ended, so it can notify
+// whoever subscribes to finished restores. A failed report is only logged.
+func reportRestore(backupID string, at *time.Time, restoreErr error) {
+	report := struct {
+		BackupID string     `json:"backupId,omitempty"`
+		At       *time.Time `json:"at,omitempty"`
+		Status   string     `json:"status"`
+		Error    string     `json:"error,omitempty"`
+	}{BackupID: backupID, At: at, Status: "completed"}
+	if restoreErr != nil {
+		report.Status = "failed"
+		report.Error = restoreErr.Error()
+	}
+		
+	jsonData, err := json.Marshal(report)
+	if err == nil {
+		err = serverRequest("POST", fmt.Sprintf("/api/devices/%s/restores", config.DeviceID), "application/json", bytes.NewBuffer(jsonData))
+	}
+	if err != nil {
+		logger.Printf("Warning: failed to report restore to server: %s", err)
+	}
+}
+
 func performBackup() error {
 	logger.Println("Starting backup process...")
 	
@@ -257,18 +594,24 @@ func performBackup() error {
 	// This would be a more sophisticated status update in a real implementation
 	
 	// Create backup
-	backupID, size, fileCount, err := createBackup()
+	plan := planBackup()
+	backupID, size, manifest, err := createBackup(plan)
 	if err != nil {
 		logger.Printf("Backup failed: %s", err)
 		return err
 	}
 	
 	// Upload backup to server
-	if err := uploadBackup(backupID, size, fileCount); err != nil {
+	if err := uploadBackup(backupID, size, manifest, plan); err != nil {
 		logger.Printf("Upload failed: %s", err)
 		return err
 	}
 	
+	// Only an uploaded backup can be the parent of the next incremental
+	if err := plan.commit(backupID, manifest); err != nil {
+		logger.Printf("Failed to save backup index: %s", err)
+	}
+	
 	logger.Println("Backup process completed successfully")
 	return nil
 }
@@ -290,10 +633,42 @@ func backupRoutine() {
 }
 
 func main() {
+	flag.Parse()
+	
+	if *genKeyFile != "" {
+		publicKey, err := generateIdentity(*genKeyFile)
+		if err != nil {
+			logger.Fatalf("Failed to generate identity: %s", err)
+		}
+		fmt.Printf("Identity written to %s\nrecipientPublicKey: %s\n", *genKeyFile, publicKey)
+		return
+	}
+	
 	if err := loadConfig(); err != nil {
 		logger.Fatalf("Failed to load configuration: %s", err)
 	}
 	
+	if *restoreID != "" {
+		err := restoreBackup(*restoreID, *restoreDir)
+		reportRestore(*restoreID, nil, err)
+		if err != nil {
+			logger.Fatalf("Restore failed: %s", err)
+		}
+		return
+	}
+	if *restoreAtTime != "" {
+		at, err := time.Parse(time.RFC3339, *restoreAtTime)
+		if err != nil {
+			logger.Fatalf("Invalid -restore-at time: %s", err)
+		}
+		backupID, err := restoreAt(at, *restoreDir)
+		reportRestore(backupID, &at, err)
+		if err != nil {
+			logger.Fatalf("Restore failed: %s", err)
+		}
+		return
+	}
+	
 	logger.Printf("Starting backup agent for device: %s", config.DeviceName)
 	logger.Printf("Server URL: %s", config.ServerURL)
 	logger.Printf("Backup interval: %d minutes", config.IntervalMinutes)
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Archives are compressed as a series of gzip members, a new one starting
+// wherever a rolling hash of the tar stream hits a cut point, as gzip
+// --rsyncable does. Data that didn't change since the last backup then
+// compresses to the same bytes, which the server's deduplicating store
+// relies on; gzip readers and tar see one ordinary stream.
+const (
+	gzipMemberMin  = 32 << 10
+	gzipMemberBits = 16 // 64 KiB average
+	gzipMemberMax  = 256 << 10
+	gzipMemberMask = ^(^uint64(0) >> gzipMemberBits)
+)
+
+// gzipGear maps bytes to random-looking values for the rolling hash. It
+// must never change, or unchanged data would stop compressing the same.
+var gzipGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'g', 'z', 'i', 'p', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return gear
+}()
+
+// rsyncableWriter gzips a stream in content-defined members.
+type rsyncableWriter struct {
+	w  io.Writer
+	gz *gzip.Writer
+	// Bytes in the current member, and the rolling hash over them.
+	n int
+	h uint64
+}
+
+func newRsyncableWriter(w io.Writer) *rsyncableWriter {
+	return &rsyncableWriter{w: w, gz: gzip.NewWriter(w)}
+}
+
+func (r *rsyncableWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		end, cut := len(p), false
+		for i, b := range p {
+			r.h = r.h<<1 + gzipGear[b]
+			r.n++
+			if r.n >= gzipMemberMax || r.n >= gzipMemberMin && r.h&gzipMemberMask == 0 {
+				end, cut = i+1, true
+				break
+			}
+		}
+		if _, err := r.gz.Write(p[:end]); err != nil {
+			return total - len(p), err
+		}
+		p = p[end:]
+		if cut {
+			if err := r.gz.Close(); err != nil {
+				return total - len(p), err
+			}
+			r.gz.Reset(r.w)
+			r.n, r.h = 0, 0
+		}
+	}
+	return total, nil
+}
+
+// Close ends the last member.
+func (r *rsyncableWriter) Close() error {
+	return r.gz.Close()
+}
+
+// archiveWriter builds a tar.gz in-process, collecting the manifest in the
+// same pass so the archive never has to be read back. Entries that can't
+// be read are skipped with a warning instead of failing the backup.
+type archiveWriter struct {
+	gz      *rsyncableWriter
+	tw      *tar.Writer
+	entries []ManifestEntry
+	// Archive paths listed but not archived, or archived incompletely.
+	skipped map[string]bool
+	warn    func(string, ...interface{})
+}
+
+func newArchiveWriter(w io.Writer, warn func(string, ...interface{})) *archiveWriter {
+	gz := newRsyncableWriter(w)
+	return &archiveWriter{
+		gz:      gz,
+		tw:      tar.NewWriter(gz),
+		entries: []ManifestEntry{},
+		skipped: map[string]bool{},
+		warn:    warn,
+	}
+}
+
+// add archives one filesystem path, without recursing into directories.
+// Only errors writing the archive itself are returned.
+func (a *archiveWriter) add(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		a.skip(path, false, err)
+		return nil
+	}
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			a.skip(path, false, err)
+			return nil
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		// Sockets and the like have no tar representation.
+		a.skip(path, info.IsDir(), err)
+		return nil
+	}
+	hdr.Name = archivePath(path, info.IsDir())
+	hdr.ModTime = info.ModTime().Truncate(time.Second)
+
+	// Open regular files before writing the header, so an unreadable one
+	// leaves no trace in the archive.
+	var f *os.File
+	if hdr.Typeflag == tar.TypeReg {
+		if f, err = os.Open(path); err != nil {
+			a.skip(path, false, err)
+			return nil
+		}
+		defer f.Close()
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	entry := ManifestEntry{
+		Path:       hdr.Name,
+		Type:       entryType(hdr.Typeflag),
+		Size:       hdr.Size,
+		Mode:       hdr.Mode,
+		ModTime:    hdr.ModTime,
+		LinkTarget: hdr.Linkname,
+	}
+	if f != nil {
+		h := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(a.tw, h), f, hdr.Size)
+		if err != nil {
+			// The header promised hdr.Size bytes; pad so the archive stays
+			// readable, and hash what was actually written. The padded copy
+			// isn't a good one, so count the file as skipped and let the
+			// next backup archive it again.
+			a.warn("%s changed or failed while being read (%d of %d bytes): %s", path, n, hdr.Size, err)
+			pad := io.LimitReader(zeroReader{}, hdr.Size-n)
+			if _, err := io.Copy(io.MultiWriter(a.tw, h), pad); err != nil {
+				return err
+			}
+			a.skipped[hdr.Name] = true
+		}
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	a.entries = append(a.entries, entry)
+	return nil
+}
+
+func (a *archiveWriter) skip(path string, dir bool, err error) {
+	a.warn("skipping %s: %s", path, err)
+	a.skipped[archivePath(path, dir)] = true
+}
+
+func (a *archiveWriter) close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeArchive writes the listed paths to a new tar.gz at dst and returns
+// the manifest entries of what it holds, plus the archive paths that had to
+// be skipped.
+func writeArchive(dst string, paths []string, warn func(string, ...interface{})) ([]ManifestEntry, map[string]bool, error) {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create backup file: %s", err)
+	}
+	a := newArchiveWriter(f, warn)
+	for _, path := range paths {
+		if err = a.add(path); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = a.close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return nil, nil, fmt.Errorf("failed to write backup archive: %s", err)
+	}
+	return a.entries, a.skipped, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// End-to-end archive encryption, modelled on age's X25519 recipients: each
+// archive gets a fresh ephemeral X25519 key, the stream key is derived with
+// HKDF from the shared secret, and the archive is sealed in 64 KiB AES-GCM
+// segments (a counter plus a final-segment flag in each nonce, so segments
+// can't be reordered or the stream truncated). Only the holder of the
+// recipient's private key can decrypt; the server just stores ciphertext.
+
+const (
+	e2eMagic       = "IHHE2E01"
+	e2eSegmentSize = 64 * 1024
+	e2eHeaderSize  = len(e2eMagic) + 32
+	e2eInfo        = "iot-helper-haven e2e v1"
+)
+
+func parseX25519Key(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes encoded as base64")
+	}
+	return key, nil
+}
+
+// keyFingerprint identifies a recipient public key in the server catalog.
+func keyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return "x25519:" + hex.EncodeToString(sum[:8])
+}
+
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %s", err)
+	}
+	raw, err := parseX25519Key(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file: %s", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// generateIdentity writes a new private key to path and returns the
+// matching public key for use as recipientPublicKey.
+func generateIdentity(path string) (string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(priv.Bytes()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return "", fmt.Errorf("failed to write identity file: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+func e2eStreamKey(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key, err := hkdf.Key(sha256.New, shared, salt, e2eInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func e2eNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptStream encrypts src to dst for the given recipient public key.
+func encryptStream(dst io.Writer, src io.Reader, recipientKey []byte) error {
+	recipient, err := ecdh.X25519().NewPublicKey(recipientKey)
+	if err != nil {
+		return err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return err
+	}
+	aead, err := e2eStreamKey(shared, ephemeral.PublicKey().Bytes(), recipientKey)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(e2eMagic), ephemeral.PublicKey().Bytes()...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Read one segment ahead so the last one can be flagged as final.
+	buf := make([]byte, e2eSegmentSize)
+	next := make([]byte, e2eSegmentSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	for index := uint64(0); ; index++ {
+		m := 0
+		if n == e2eSegmentSize {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		final := m == 0
+		if _, err := dst.Write(aead.Seal(nil, e2eNonce(index, final), buf[:n], header)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
+
+// isEncryptedStream reports whether data starts with the e2e header magic.
+func isEncryptedStream(data []byte) bool {
+	return len(data) >= len(e2eMagic) && string(data[:len(e2eMagic)]) == e2eMagic
+}
+
+// decryptStream decrypts an archive produced by encryptStream.
+func decryptStream(dst io.Writer, src io.Reader, identity *ecdh.PrivateKey) error {
+	header := make([]byte, e2eHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("failed to read archive header: %s", err)
+	}
+	if !isEncryptedStream(header) {
+		return errors.New("archive is not end-to-end encrypted")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[len(e2eMagic):])
+	if err != nil {
+		return err
+	}
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return err
+	}
+	aead, err := e2eStreamKey(shared, ephemeral.Bytes(), identity.PublicKey().Bytes())
+	if err != nil {
+		return err
+	}
+
+	segment := e2eSegmentSize + aead.Overhead()
+	buf := make([]byte, segment)
+	next := make([]byte, segment)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	for index := uint64(0); ; index++ {
+		m := 0
+		if n == segment {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		final := m == 0
+		plain, err := aead.Open(nil, e2eNonce(index, final), buf[:n], header)
+		if err != nil {
+			return fmt.Errorf("archive segment %d failed authentication (wrong key or corrupted data)", index)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		buf, next, n = next, buf, m
+	}
+}
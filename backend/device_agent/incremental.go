@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Incremental backups: the agent keeps an index of every path it backed up
+// last time, and archives only the entries whose size, mode, mtime or link
+// target changed since. A file whose mtime moved but whose content hashes
+// the same is not archived again. Paths that disappeared are recorded in
+// the manifest so the server can apply the deletions when it merges a
+// chain. A full backup is taken every FullBackupDays.
+
+// Backup kinds, as recorded by the server.
+const (
+	backupFull        = "full"
+	backupIncremental = "incremental"
+)
+
+// IndexEntry is the state of one path as of the last backup. Mode holds
+// the permission, setuid, setgid and sticky bits of its fs.FileMode.
+type IndexEntry struct {
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	Mode    int64     `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// BackupIndex is saved in the backup directory after every uploaded backup.
+// Entries are keyed by archive path ("etc/hosts", "etc/ssh/").
+type BackupIndex struct {
+	BackupID     string                `json:"backupId"`
+	FullBackupID string                `json:"fullBackupId"`
+	FullAt       time.Time             `json:"fullAt"`
+	Entries      map[string]IndexEntry `json:"entries"`
+}
+
+// backupPlan says what a run archives: everything for a full backup, or
+// only what changed since the parent for an incremental one.
+type backupPlan struct {
+	kind     string
+	parentID string
+	// Filesystem paths to archive, non-recursively.
+	paths []string
+	// Archive paths removed since the parent.
+	deleted []string
+	index   *BackupIndex
+	// The parent's index, for an incremental.
+	prev     *BackupIndex
+	warnings []string
+	// Archive paths that were listed but couldn't be archived.
+	skipped map[string]bool
+}
+
+// warn logs a problem that doesn't stop the backup and reports it to the
+// server along with it.
+func (plan *backupPlan) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Printf("Warning: %s", msg)
+	plan.warnings = append(plan.warnings, msg)
+}
+
+func indexPath() string {
+	return filepath.Join(config.BackupDir, "index.json")
+}
+
+func loadIndex() (*BackupIndex, error) {
+	data, err := os.ReadFile(indexPath())
+	if err != nil {
+		return nil, err
+	}
+	var index BackupIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse backup index: %s", err)
+	}
+	if index.Entries == nil {
+		index.Entries = map[string]IndexEntry{}
+	}
+	return &index, nil
+}
+
+// saveIndex replaces the index atomically, so a crash never leaves the next
+// incremental without a parent.
+func saveIndex(index *BackupIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write backup index: %s", err)
+	}
+	if err := os.Rename(tmp, indexPath()); err != nil {
+		return fmt.Errorf("failed to write backup index: %s", err)
+	}
+	return nil
+}
+
+// archivePath is the name tar gives a filesystem path.
+func archivePath(path string, dir bool) string {
+	name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if dir {
+		name += "/"
+	}
+	return name
+}
+
+// changed reports whether a path must be archived again, hashing the file
+// only when its metadata alone can't tell.
+func (e *IndexEntry) changed(prev IndexEntry, ok bool, path string) bool {
+	if !ok || e.Dir != prev.Dir || e.Mode != prev.Mode || e.Link != prev.Link || e.Size != prev.Size {
+		return true
+	}
+	if e.ModTime.Equal(prev.ModTime) {
+		e.SHA256 = prev.SHA256
+		return false
+	}
+	if e.Dir || e.Link != "" || prev.SHA256 == "" {
+		return true
+	}
+	sum, err := fileSHA256(path)
+	if err != nil || sum != prev.SHA256 {
+		return true
+	}
+	e.SHA256 = sum
+	return false
+}
+
+// planBackup decides between a full and an incremental backup and, for an
+// incremental, works out what changed since the last uploaded backup.
+func planBackup() *backupPlan {
+	plan := &backupPlan{kind: backupFull}
+	entries, paths, gaps := scanPaths(plan.warn)
+	plan.index = &BackupIndex{Entries: entries}
+	plan.paths = []string{}
+	for _, p := range paths {
+		plan.paths = append(plan.paths, p)
+	}
+	sort.Strings(plan.paths)
+	if !config.Incremental {
+		return plan
+	}
+
+	prev, err := loadIndex()
+	switch {
+	case os.IsNotExist(err):
+		logger.Println("No backup index yet, taking a full backup")
+		return plan
+	case err != nil:
+		logger.Printf("Warning: %s, taking a full backup", err)
+		return plan
+	case time.Since(prev.FullAt) >= time.Duration(config.FullBackupDays)*24*time.Hour:
+		logger.Printf("Last full backup is older than %d days, taking a full backup", config.FullBackupDays)
+		return plan
+	case !backupOnServer(prev.BackupID):
+		logger.Printf("Backup %s is no longer on the server, taking a full backup", prev.BackupID)
+		return plan
+	}
+
+	plan.kind = backupIncremental
+	plan.parentID = prev.BackupID
+	plan.prev = prev
+	plan.index.FullBackupID = prev.FullBackupID
+	plan.index.FullAt = prev.FullAt
+	plan.paths = []string{}
+	plan.deleted = []string{}
+	for name, entry := range entries {
+		old, ok := prev.Entries[name]
+		if entry.changed(old, ok, paths[name]) {
+			plan.paths = append(plan.paths, paths[name])
+		}
+		entries[name] = entry
+	}
+	for name, old := range prev.Entries {
+		if _, ok := entries[name]; ok {
+			continue
+		}
+		if gaps.covers(name) {
+			// Not readable this time: keep what the server already has
+			// instead of recording a deletion.
+			entries[name] = old
+			continue
+		}
+		plan.deleted = append(plan.deleted, name)
+	}
+	sort.Strings(plan.paths)
+	sort.Strings(plan.deleted)
+	return plan
+}
+
+func (index *BackupIndex) entry(name string) (IndexEntry, bool) {
+	if index == nil {
+		return IndexEntry{}, false
+	}
+	entry, ok := index.Entries[name]
+	return entry, ok
+}
+
+// commit records the uploaded backup as the parent of the next incremental.
+// Hashes come from the manifest, which covers every file the archive holds.
+func (plan *backupPlan) commit(backupID string, manifest *Manifest) error {
+	index := plan.index
+	index.BackupID = backupID
+	if plan.kind == backupFull {
+		index.FullBackupID = backupID
+		index.FullAt = time.Now()
+	}
+	for _, m := range manifest.Entries {
+		if entry, ok := index.Entries[m.Path]; ok && m.Type == "file" {
+			entry.SHA256 = m.SHA256
+			index.Entries[m.Path] = entry
+		}
+	}
+	// A skipped entry keeps the state the server has for it, so the next
+	// incremental tries it again.
+	for name := range plan.skipped {
+		if old, ok := plan.prev.entry(name); ok {
+			index.Entries[name] = old
+		} else {
+			delete(index.Entries, name)
+		}
+	}
+	return saveIndex(index)
+}
+
+// backupOnServer reports whether the server holds a completed backup.
+func backupOnServer(backupID string) bool {
+	if backupID == "" {
+		return false
+	}
+	var backup struct {
+		Status string `json:"status"`
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/api/backups/%s", config.ServerURL, backupID))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&backup) == nil && backup.Status == "completed"
+}
+
+// restorePlan is the server's chain for restoring the device as of a point
+// in time, full backup first.
+type restorePlan struct {
+	BackupID string `json:"backupId"`
+	Links    []struct {
+		BackupID       string   `json:"backupId"`
+		Kind           string   `json:"kind"`
+		Deleted        []string `json:"deleted"`
+		SealedManifest string   `json:"sealedManifest"`
+	} `json:"links"`
+	Problems []string `json:"problems"`
+}
+
+// restoreAt restores the device as it was at the given time by extracting
+// every backup of the chain in order, applying each incremental's deletions
+// first. The server checks the whole chain before anything is extracted.
+// It returns the backup the restored state comes from, once known.
+func restoreAt(at time.Time, dir string) (string, error) {
+	url := fmt.Sprintf("%s/api/devices/%s/restore-plan?verify=true&at=%s", config.ServerURL, config.DeviceID, at.UTC().Format(time.RFC3339))
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to get restore plan: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to get restore plan: %s", strings.TrimSpace(string(body)))
+	}
+	var plan restorePlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return "", fmt.Errorf("failed to parse restore plan: %s", err)
+	}
+	if len(plan.Problems) > 0 {
+		return plan.BackupID, fmt.Errorf("backup chain is not restorable: %s", strings.Join(plan.Problems, "; "))
+	}
+
+	logger.Printf("Restoring state as of %s from backup %s (%d archive(s))", at.Format(time.RFC3339), plan.BackupID, len(plan.Links))
+	var identity *ecdh.PrivateKey
+	for _, link := range plan.Links {
+		if link.Kind == backupIncremental {
+			deleted := link.Deleted
+			// End-to-end encrypted backups keep their deletions sealed.
+			if link.SealedManifest != "" {
+				if identity == nil {
+					if config.IdentityFile == "" {
+						return plan.BackupID, fmt.Errorf("backup %s is end-to-end encrypted but no identityFile is configured", link.BackupID)
+					}
+					if identity, err = loadIdentity(config.IdentityFile); err != nil {
+						return plan.BackupID, err
+					}
+				}
+				manifest, err := openSealedManifest(link.SealedManifest, identity)
+				if err != nil {
+					return plan.BackupID, fmt.Errorf("backup %s: %s", link.BackupID, err)
+				}
+				deleted = manifest.Deleted
+			}
+			if err := removeDeleted(dir, deleted); err != nil {
+				return plan.BackupID, err
+			}
+		}
+		if err := restoreBackup(link.BackupID, dir); err != nil {
+			return plan.BackupID, err
+		}
+	}
+	return plan.BackupID, nil
+}
+
+// removeDeleted removes the paths an incremental backup recorded as deleted
+// from a restore directory.
+func removeDeleted(dir string, deleted []string) error {
+	root := filepath.Clean(dir)
+	for _, name := range deleted {
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if rel, err := filepath.Rel(root, target); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			logger.Printf("Warning: ignoring deleted path outside the restore directory: %s", name)
+			continue
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to remove deleted path %s: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ManifestEntry describes one entry of a backup archive.
+type ManifestEntry struct {
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Mode       int64     `json:"mode"`
+	ModTime    time.Time `json:"mtime"`
+	SHA256     string    `json:"sha256,omitempty"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
+// Manifest is sent to the server with every backup so it can prove the
+// stored archive is intact. ArchiveSHA256 covers the file as uploaded.
+// Deleted lists the paths an incremental backup removes from its parent.
+// For an end-to-end encrypted backup, Entries and Deleted are sealed to the
+// recipient (see sealManifest) and only the archive hash is sent in clear.
+type Manifest struct {
+	ArchiveSHA256 string          `json:"archiveSha256"`
+	Entries       []ManifestEntry `json:"entries"`
+	Deleted       []string        `json:"deleted,omitempty"`
+	Sealed        string          `json:"sealed,omitempty"`
+}
+
+// sealManifest returns the manifest to send for an end-to-end encrypted
+// backup: the archive hash, plus the file list encrypted to the recipient.
+func sealManifest(manifest *Manifest, recipient []byte) (*Manifest, error) {
+	data, err := json.Marshal(Manifest{Entries: manifest.Entries, Deleted: manifest.Deleted})
+	if err != nil {
+		return nil, err
+	}
+	var sealed bytes.Buffer
+	if err := encryptStream(&sealed, bytes.NewReader(data), recipient); err != nil {
+		return nil, fmt.Errorf("failed to seal manifest: %s", err)
+	}
+	return &Manifest{
+		ArchiveSHA256: manifest.ArchiveSHA256,
+		Entries:       []ManifestEntry{},
+		Sealed:        base64.StdEncoding.EncodeToString(sealed.Bytes()),
+	}, nil
+}
+
+// openSealedManifest decrypts a manifest sealed by sealManifest.
+func openSealedManifest(sealed string, identity *ecdh.PrivateKey) (*Manifest, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed manifest: %s", err)
+	}
+	var plain bytes.Buffer
+	if err := decryptStream(&plain, bytes.NewReader(data), identity); err != nil {
+		return nil, fmt.Errorf("failed to open sealed manifest: %s", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(plain.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse sealed manifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+func entryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return "other"
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Paths backed up when the config doesn't list any.
+var defaultIncludePaths = []string{"/etc", "/var/log"}
+
+// ignoreFileName names the per-directory exclude files read while scanning.
+const ignoreFileName = ".backupignore"
+
+// ignoreRule is one exclude pattern. Config excludes and .backupignore
+// files share a gitignore-like syntax:
+//
+//   - blank lines and lines starting with # are skipped
+//   - a leading ! re-includes what an earlier pattern excluded
+//   - a trailing / makes the pattern match directories only
+//   - a pattern containing a / is matched against the path relative to the
+//     directory holding the ignore file (the filesystem root for config
+//     excludes); any other pattern matches a name at any depth
+//   - *, ? and [...] work as in path.Match, and ** matches any number of
+//     directories
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+type ignoreRules []ignoreRule
+
+// parseIgnoreRule parses one pattern relative to base, reporting ok=false
+// for blank lines and comments.
+func parseIgnoreRule(base, line string) (ignoreRule, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+	rule := ignoreRule{base: filepath.ToSlash(base)}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	if rule.pattern == "" {
+		return ignoreRule{}, false, fmt.Errorf("empty pattern")
+	}
+	for _, seg := range strings.Split(rule.pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return ignoreRule{}, false, fmt.Errorf("bad pattern %q", line)
+		}
+	}
+	return rule, true, nil
+}
+
+// matchSegments matches path segments against pattern segments, letting a
+// "**" segment stand for any number of path segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func (rule ignoreRule) matches(p string, dir bool) bool {
+	if rule.dirOnly && !dir {
+		return false
+	}
+	p = filepath.ToSlash(p)
+	if !rule.anchored {
+		ok, _ := path.Match(rule.pattern, path.Base(p))
+		return ok
+	}
+	rel := strings.TrimPrefix(p, strings.TrimSuffix(rule.base, "/")+"/")
+	if rel == p {
+		return false
+	}
+	return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// excluded applies the rules in order; the last one that matches decides.
+func (rules ignoreRules) excluded(p string, dir bool) bool {
+	excluded := false
+	for _, rule := range rules {
+		if rule.matches(p, dir) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// loadIgnoreFile reads the .backupignore in dir, if there is one. Bad
+// patterns are skipped with a warning.
+func loadIgnoreFile(dir string, warn func(string, ...interface{})) ignoreRules {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warn("cannot read %s: %s", filepath.Join(dir, ignoreFileName), err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	rules := ignoreRules{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		rule, ok, err := parseIgnoreRule(dir, scanner.Text())
+		if err != nil {
+			warn("%s line %d: %s", filepath.Join(dir, ignoreFileName), n, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// configRules parses the configured exclude patterns.
+func configRules(warn func(string, ...interface{})) ignoreRules {
+	rules := ignoreRules{}
+	for _, pattern := range config.ExcludePatterns {
+		rule, ok, err := parseIgnoreRule("/", pattern)
+		if err != nil {
+			warn("excludePatterns: %s", err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// scanGaps holds the archive paths, without a trailing slash, that a scan
+// couldn't read: the path itself, or everything under a directory that
+// couldn't be listed. Their absence says nothing about whether they still
+// exist.
+type scanGaps map[string]bool
+
+// covers reports whether name is, or is under, a path the scan missed.
+func (gaps scanGaps) covers(name string) bool {
+	for p := strings.TrimSuffix(name, "/"); ; {
+		if gaps[p] {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
+
+// scanPaths records the current state of everything to back up, keyed by
+// archive path, along with the filesystem path of each, and what it
+// couldn't read. Include paths that are invalid or missing, unreadable
+// directories and bad exclude patterns are passed to warn; the rest of the
+// backup goes ahead.
+func scanPaths(warn func(string, ...interface{})) (map[string]IndexEntry, map[string]string, scanGaps) {
+	entries := map[string]IndexEntry{}
+	paths := map[string]string{}
+	gaps := scanGaps{}
+
+	base := configRules(warn)
+	// The rules in force inside each directory scanned so far.
+	dirRules := map[string]ignoreRules{}
+	rulesFor := func(dir string) ignoreRules {
+		if rules, ok := dirRules[dir]; ok {
+			return rules
+		}
+		return base
+	}
+	// Never back up the agent's own archives.
+	skip := map[string]bool{filepath.Clean(config.BackupDir): true, filepath.Clean(config.LocalStorageDir): true}
+
+	for _, root := range config.IncludePaths {
+		if !filepath.IsAbs(root) {
+			warn("include path %q is not absolute, skipping it", root)
+			continue
+		}
+		root = filepath.Clean(root)
+		if _, err := os.Lstat(root); err != nil {
+			warn("include path %s: %s", root, err)
+			if !os.IsNotExist(err) {
+				gaps[archivePath(root, false)] = true
+			}
+			continue
+		}
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				warn("cannot scan %s: %s", p, err)
+				gaps[archivePath(p, false)] = true
+				return nil
+			}
+			if d.IsDir() && skip[p] {
+				return fs.SkipDir
+			}
+			if p != root && rulesFor(filepath.Dir(p)).excluded(p, d.IsDir()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				warn("cannot stat %s: %s", p, err)
+				gaps[archivePath(p, false)] = true
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			entry := IndexEntry{
+				Dir:     d.IsDir(),
+				Size:    info.Size(),
+				Mode:    int64(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)),
+				ModTime: info.ModTime().Truncate(time.Second),
+			}
+			if entry.Dir {
+				entry.Size = 0
+				rules := rulesFor(filepath.Dir(p))
+				if extra := loadIgnoreFile(p, warn); len(extra) > 0 {
+					rules = append(append(ignoreRules{}, rules...), extra...)
+				}
+				dirRules[p] = rules
+			}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				entry.Size = 0
+				entry.Link, _ = os.Readlink(p)
+			}
+			name := archivePath(p, entry.Dir)
+			entries[name] = entry
+			paths[name] = p
+			return nil
+		})
+	}
+	return entries, paths, gaps
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// FileChange describes how one path differs between two backups.
+type FileChange struct {
+	Path      string   `json:"path"`
+	Type      string   `json:"type"`
+	Changed   []string `json:"changed,omitempty"`
+	OldSize   int64    `json:"oldSize,omitempty"`
+	NewSize   int64    `json:"newSize,omitempty"`
+	OldSHA256 string   `json:"oldSha256,omitempty"`
+	NewSHA256 string   `json:"newSha256,omitempty"`
+	OldMode   int64    `json:"oldMode,omitempty"`
+	NewMode   int64    `json:"newMode,omitempty"`
+	Diff      string   `json:"diff,omitempty"`
+}
+
+// BackupDiff lists the files added, removed and modified going from one
+// backup to a later one.
+type BackupDiff struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Added    []FileChange `json:"added"`
+	Removed  []FileChange `json:"removed"`
+	Modified []FileChange `json:"modified"`
+}
+
+const (
+	// Only files up to this size (on both sides) get a content diff.
+	maxTextDiffSize = 64 * 1024
+	diffContext     = 3
+	// Give up on a content diff needing more edits than this.
+	maxDiffEdits = 1000
+)
+
+// diffManifests compares two manifests by path. Entries whose type, content
+// hash, mode or link target differ count as modified; a changed mtime
+// alone does not.
+func diffManifests(from, to *Manifest) BackupDiff {
+	diff := BackupDiff{Added: []FileChange{}, Removed: []FileChange{}, Modified: []FileChange{}}
+
+	old := map[string]ManifestEntry{}
+	for _, entry := range from.Entries {
+		old[indexPath(entry.Path)] = entry
+	}
+	seen := map[string]bool{}
+	for _, entry := range to.Entries {
+		p := indexPath(entry.Path)
+		seen[p] = true
+		prev, ok := old[p]
+		if !ok {
+			diff.Added = append(diff.Added, FileChange{Path: p, Type: entry.Type, NewSize: entry.Size, NewSHA256: entry.SHA256, NewMode: entry.Mode})
+			continue
+		}
+		changed := []string{}
+		if prev.Type != entry.Type {
+			changed = append(changed, "type")
+		}
+		if prev.SHA256 != entry.SHA256 || prev.Size != entry.Size {
+			changed = append(changed, "content")
+		}
+		if prev.Mode != entry.Mode {
+			changed = append(changed, "mode")
+		}
+		if prev.LinkTarget != entry.LinkTarget {
+			changed = append(changed, "linkTarget")
+		}
+		if len(changed) > 0 {
+			diff.Modified = append(diff.Modified, FileChange{
+				Path: p, Type: entry.Type, Changed: changed,
+				OldSize: prev.Size, NewSize: entry.Size,
+				OldSHA256: prev.SHA256, NewSHA256: entry.SHA256,
+				OldMode: prev.Mode, NewMode: entry.Mode,
+			})
+		}
+	}
+	for p, entry := range old {
+		if !seen[p] {
+			diff.Removed = append(diff.Removed, FileChange{Path: p, Type: entry.Type, OldSize: entry.Size, OldSHA256: entry.SHA256, OldMode: entry.Mode})
+		}
+	}
+
+	for _, list := range [][]FileChange{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return diff
+}
+
+// readArchiveFiles returns the contents of the requested regular files.
+func readArchiveFiles(backup *Backup, paths map[string]bool) (map[string][]byte, error) {
+	contents := map[string][]byte{}
+	err := walkArchive(backup, func(hdr *tar.Header, tr *tar.Reader) error {
+		p := indexPath(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !paths[p] {
+			return nil
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxTextDiffSize+1))
+		if err != nil {
+			return err
+		}
+		contents[p] = data
+		if len(contents) == len(paths) {
+			return io.EOF
+		}
+		return nil
+	})
+	return contents, err
+}
+
+// chainFiles records which link of a backup's chain holds the contents of
+// each path (in indexPath form) of its merged file list.
+type chainFiles struct {
+	links []Backup
+	owner map[string]int
+}
+
+// backupFiles works out, for every path of a backup as of when it was
+// taken, the newest link of its chain that archived it and didn't later
+// delete it. The caller must hold dataMu.
+func backupFiles(backup *Backup) (*chainFiles, error) {
+	chain, err := backupChain(backup)
+	if err != nil {
+		return nil, err
+	}
+	files := &chainFiles{links: []Backup{}, owner: map[string]int{}}
+	owner := map[string]int{}
+	for i, link := range chain {
+		manifest, ok := manifests[link.ID]
+		if !ok {
+			return nil, fmt.Errorf("backup %s has no manifest", link.ID)
+		}
+		if deleted := manifestDeletions(manifest); len(deleted) > 0 {
+			for p := range owner {
+				if deleted.covers(p) {
+					delete(owner, p)
+				}
+			}
+		}
+		for _, entry := range manifest.Entries {
+			owner[entry.Path] = i
+		}
+		files.links = append(files.links, *link)
+	}
+	for p, i := range owner {
+		files.owner[indexPath(p)] = i
+	}
+	return files, nil
+}
+
+// read returns the contents of the requested regular files, reading each
+// link's archive at most once.
+func (files *chainFiles) read(paths map[string]bool) (map[string][]byte, error) {
+	byLink := map[int]map[string]bool{}
+	for p := range paths {
+		i, ok := files.owner[p]
+		if !ok {
+			continue
+		}
+		if byLink[i] == nil {
+			byLink[i] = map[string]bool{}
+		}
+		byLink[i][p] = true
+	}
+	contents := map[string][]byte{}
+	for i, wanted := range byLink {
+		found, err := readArchiveFiles(&files.links[i], wanted)
+		if err != nil {
+			return nil, err
+		}
+		for p, data := range found {
+			contents[p] = data
+		}
+	}
+	return contents, nil
+}
+
+func isText(data []byte) bool {
+	return len(data) <= maxTextDiffSize && bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind         byte // ' ', '-' or '+'
+	line         string
+	aLine, bLine int
+}
+
+// diffLines computes a shortest edit script between a and b (Myers' O(ND)
+// algorithm). It returns nil if the files differ by more than maxDiffEdits.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	trace := [][]int{}
+
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace, offset)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(a, b []string, trace [][]int, offset int) []diffOp {
+	ops := []diffOp{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{kind: ' ', line: a[x], aLine: x, bLine: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{kind: '+', line: b[prevY], aLine: x, bLine: prevY})
+			} else {
+				ops = append(ops, diffOp{kind: '-', line: a[prevX], aLine: prevX, bLine: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff renders a diff of two texts in unified format. ok is false
+// when the change is too large to diff.
+func unifiedDiff(name, a, b string) (string, bool) {
+	ops := diffLines(splitLines(a), splitLines(b))
+	if ops == nil {
+		return "", false
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a%s\n+++ b%s\n", name, name)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			} else if j-end > 2*diffContext {
+				break
+			}
+		}
+		stop := end + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aStart, bStart, aCount, bCount := ops[start].aLine, ops[start].bLine, 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	return out.String(), true
+}
+
+// addContentDiffs fills in unified diffs for small modified text files,
+// reading each side from whichever link of its chain holds the file.
+func addContentDiffs(diff *BackupDiff, from, to *chainFiles) error {
+	wanted := map[string]bool{}
+	for _, change := range diff.Modified {
+		if change.Type == "file" && change.OldSHA256 != change.NewSHA256 &&
+			change.OldSize <= maxTextDiffSize && change.NewSize <= maxTextDiffSize {
+			wanted[change.Path] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	oldFiles, err := from.read(wanted)
+	if err != nil {
+		return err
+	}
+	newFiles, err := to.read(wanted)
+	if err != nil {
+		return err
+	}
+	for i, change := range diff.Modified {
+		a, okA := oldFiles[change.Path]
+		b, okB := newFiles[change.Path]
+		if !okA || !okB || !isText(a) || !isText(b) {
+			continue
+		}
+		if text, ok := unifiedDiff(change.Path, string(a), string(b)); ok {
+			diff.Modified[i].Diff = text
+		}
+	}
+	return nil
+}
+
+// Diff handlers
+func diffBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fromID, toID := vars["backupId"], vars["otherId"]
+
+	dataMu.Lock()
+	fromBackup, toBackup := findBackup(fromID), findBackup(toID)
+	var from, to Backup
+	if fromBackup != nil && toBackup != nil {
+		from, to = *fromBackup, *toBackup
+	}
+	var fromManifest, toManifest *Manifest
+	var fromFiles, toFiles *chainFiles
+	var fromErr, toErr error
+	if fromBackup != nil && toBackup != nil {
+		fromManifest, fromErr = mergedManifest(fromBackup)
+		toManifest, toErr = mergedManifest(toBackup)
+		if fromErr == nil && toErr == nil {
+			fromFiles, fromErr = backupFiles(fromBackup)
+			toFiles, toErr = backupFiles(toBackup)
+		}
+	}
+	dataMu.Unlock()
+
+	if fromBackup == nil || toBackup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if from.DeviceID != to.DeviceID {
+		http.Error(w, "Backups belong to different devices", http.StatusBadRequest)
+		return
+	}
+	if fromErr != nil || toErr != nil {
+		err := fromErr
+		if err == nil {
+			err = toErr
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	diff := diffManifests(fromManifest, toManifest)
+	diff.From, diff.To = fromID, toID
+	if from.EncryptionKey == "" && to.EncryptionKey == "" {
+		if err := addContentDiffs(&diff, fromFiles, toFiles); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read archives: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
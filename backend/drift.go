@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DriftRule controls which changes between successive backups of a device
+// are reported as configuration drift. Watch entries are path prefixes;
+// Ignore entries are either prefixes or glob patterns (patterns without a
+// slash match the file name, e.g. "*.log").
+type DriftRule struct {
+	DeviceID string   `json:"deviceId"`
+	Watch    []string `json:"watch"`
+	Ignore   []string `json:"ignore"`
+}
+
+// DriftReport lists the watched files that changed since the device's
+// previous backup.
+type DriftReport struct {
+	BackupID         string       `json:"backupId"`
+	PreviousBackupID string       `json:"previousBackupId"`
+	DeviceID         string       `json:"deviceId"`
+	DetectedAt       time.Time    `json:"detectedAt"`
+	Changes          []FileChange `json:"changes"`
+}
+
+// Change kinds used in drift reports
+const (
+	driftAdded    = "added"
+	driftRemoved  = "removed"
+	driftModified = "modified"
+)
+
+// driftLogLimit caps how many paths are spelled out in the log message.
+const driftLogLimit = 20
+
+var defaultDriftRule = DriftRule{Watch: []string{"/etc"}, Ignore: []string{}}
+
+// Drift rules by device ID, and drift reports by backup ID
+var driftRules = map[string]DriftRule{}
+var driftReports = map[string]DriftReport{}
+
+func driftRuleFor(deviceID string) DriftRule {
+	if rule, ok := driftRules[deviceID]; ok {
+		return rule
+	}
+	rule := defaultDriftRule
+	rule.DeviceID = deviceID
+	return rule
+}
+
+func underPath(p, prefix string) bool {
+	prefix = indexPath(prefix)
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func (rule DriftRule) matches(p string) bool {
+	watched := false
+	for _, w := range rule.Watch {
+		if underPath(p, w) {
+			watched = true
+			break
+		}
+	}
+	if !watched {
+		return false
+	}
+	for _, pattern := range rule.Ignore {
+		if !strings.ContainsAny(pattern, "*?[") {
+			if underPath(p, pattern) {
+				return false
+			}
+			continue
+		}
+		target := p
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return false
+		}
+	}
+	return true
+}
+
+func validDriftRule(rule DriftRule) error {
+	for _, pattern := range rule.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// previousBackup returns the latest completed backup of the same device,
+// older than backup, that has a manifest. Failed and in-progress uploads
+// don't describe the device's state. The caller must hold dataMu.
+func previousBackup(backup *Backup) *Backup {
+	var prev *Backup
+	for i := range backups {
+		b := &backups[i]
+		if b.DeviceID != backup.DeviceID || b.ID == backup.ID || !b.Timestamp.Before(backup.Timestamp) {
+			continue
+		}
+		if b.Status != "completed" {
+			continue
+		}
+		if _, ok := manifests[b.ID]; !ok {
+			continue
+		}
+		if prev == nil || b.Timestamp.After(prev.Timestamp) {
+			prev = b
+		}
+	}
+	return prev
+}
+
+// detectDrift compares a newly ingested backup with the device's previous
+// one and logs a "config drift" event for changes under watched paths. The
+// caller must hold dataMu.
+func detectDrift(backup *Backup) {
+	if _, ok := manifests[backup.ID]; !ok {
+		return
+	}
+	prev := previousBackup(backup)
+	if prev == nil {
+		return
+	}
+	// Incrementals are compared by the full file list they stand for.
+	manifest, err := mergedManifest(backup)
+	if err != nil {
+		return
+	}
+	prevManifest, err := mergedManifest(prev)
+	if err != nil {
+		return
+	}
+
+	rule := driftRuleFor(backup.DeviceID)
+	diff := diffManifests(prevManifest, manifest)
+	changes := []FileChange{}
+	for kind, list := range map[string][]FileChange{driftAdded: diff.Added, driftRemoved: diff.Removed, driftModified: diff.Modified} {
+		for _, change := range list {
+			if rule.matches(change.Path) {
+				change.Changed = append([]string{kind}, change.Changed...)
+				changes = append(changes, change)
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	report := DriftReport{
+		BackupID:         backup.ID,
+		PreviousBackupID: prev.ID,
+		DeviceID:         backup.DeviceID,
+		DetectedAt:       time.Now(),
+		Changes:          changes,
+	}
+	driftReports[backup.ID] = report
+
+	listed := []string{}
+	for i, change := range changes {
+		if i == driftLogLimit {
+			listed = append(listed, fmt.Sprintf("and %d more", len(changes)-driftLogLimit))
+			break
+		}
+		listed = append(listed, fmt.Sprintf("%s (%s)", change.Path, change.Changed[0]))
+	}
+	logs = append(logs, BackupLog{
+		Timestamp: report.DetectedAt,
+		Level:     "warning",
+		Message:   fmt.Sprintf("Config drift: %d watched file(s) changed since backup %s: %s", len(changes), prev.ID, strings.Join(listed, ", ")),
+		DeviceID:  backup.DeviceID,
+		BackupID:  backup.ID,
+	})
+}
+
+// Drift handlers
+func getDriftRuleHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(driftRuleFor(deviceID))
+}
+
+func updateDriftRuleHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var rule DriftRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validDriftRule(rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.DeviceID = deviceID
+	if rule.Watch == nil {
+		rule.Watch = []string{}
+	}
+	if rule.Ignore == nil {
+		rule.Ignore = []string{}
+	}
+	driftRules[deviceID] = rule
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func getDriftReportHandler(w http.ResponseWriter, r *http.Request) {
+	backupID := mux.Vars(r)["backupId"]
+	if findBackup(backupID) == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	report, ok := driftReports[backupID]
+	if !ok {
+		http.Error(w, "No drift detected for this backup", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig configures the email notifier. TLS is "starttls" (upgrade a
+// plain connection, the default), "tls" (implicit TLS, usually port 465) or
+// "none".
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+	TLS      string
+	// Event types to email; empty means every warning or error event.
+	Events []string
+	// Time of day ("15:04", server local time) to send the daily digest;
+	// empty disables it.
+	DigestTime string
+}
+
+const emailTimeout = 30 * time.Second
+
+// Email notifier settings; nil when SMTP_HOST is not set.
+var smtpConfig *SMTPConfig
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadSMTPConfig reads the SMTP_* and DIGEST_TIME environment variables.
+func loadSMTPConfig() (*SMTPConfig, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	cfg := &SMTPConfig{
+		Host:       host,
+		Port:       587,
+		Username:   os.Getenv("SMTP_USERNAME"),
+		Password:   os.Getenv("SMTP_PASSWORD"),
+		From:       os.Getenv("SMTP_FROM"),
+		To:         splitList(os.Getenv("SMTP_TO")),
+		TLS:        "starttls",
+		Events:     splitList(os.Getenv("SMTP_EVENTS")),
+		DigestTime: os.Getenv("DIGEST_TIME"),
+	}
+	if v := os.Getenv("SMTP_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid SMTP_PORT: %s", v)
+		}
+		cfg.Port = port
+	}
+	if v := os.Getenv("SMTP_TLS"); v != "" {
+		cfg.TLS = v
+	}
+	switch cfg.TLS {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("invalid SMTP_TLS: %s", cfg.TLS)
+	}
+	if cfg.From == "" {
+		return nil, fmt.Errorf("SMTP_FROM is required")
+	}
+	if len(cfg.To) == 0 {
+		return nil, fmt.Errorf("SMTP_TO is required")
+	}
+	for _, t := range cfg.Events {
+		known := false
+		for _, k := range eventTypes {
+			known = known || t == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type in SMTP_EVENTS: %s", t)
+		}
+	}
+	if cfg.DigestTime != "" {
+		if _, err := time.Parse("15:04", cfg.DigestTime); err != nil {
+			return nil, fmt.Errorf("invalid DIGEST_TIME: %s", cfg.DigestTime)
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg *SMTPConfig) wants(event Event) bool {
+	if len(cfg.Events) == 0 {
+		return event.Level == "warning" || event.Level == "error"
+	}
+	for _, t := range cfg.Events {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// sendEmail delivers a plain-text message to the configured recipients.
+func sendEmail(cfg *SMTPConfig, subject, body string) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	if cfg.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if cfg.TLS == "starttls" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %s", err)
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %s", err)
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %s", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMessage(cfg, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func buildMessage(cfg *SMTPConfig, subject, body string) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := cfg.Host
+	if at := strings.LastIndex(cfg.From, "@"); at >= 0 {
+		domain = strings.Trim(cfg.From[at+1:], ">")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(msg.String())
+}
+
+// notifyEmail emails an event if the notifier is configured for it. The
+// caller must hold dataMu.
+func notifyEmail(event Event) {
+	cfg := smtpConfig
+	if cfg == nil || !cfg.wants(event) {
+		return
+	}
+
+	subject := fmt.Sprintf("[IoT Backup] %s: %s", event.Type, event.Message)
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", event.Message)
+	fmt.Fprintf(&body, "Event:   %s (%s)\n", event.Type, event.Level)
+	fmt.Fprintf(&body, "Time:    %s\n", event.Timestamp.Format(time.RFC1123))
+	if event.DeviceID != "" {
+		name := event.DeviceID
+		if device := findDevice(event.DeviceID); device != nil {
+			name = fmt.Sprintf("%s (%s)", device.Name, device.ID)
+		}
+		fmt.Fprintf(&body, "Device:  %s\n", name)
+	}
+	if event.BackupID != "" {
+		fmt.Fprintf(&body, "Backup:  %s\n", event.BackupID)
+	}
+	if len(event.Data) > 0 {
+		data, _ := json.MarshalIndent(event.Data, "", "  ")
+		fmt.Fprintf(&body, "\nDetails:\n%s\n", data)
+	}
+
+	go func() {
+		if err := sendEmail(cfg, subject, body.String()); err != nil {
+			fmt.Printf("Failed to email %s event %s: %s\n", event.Type, event.ID, err)
+		}
+	}()
+}
+
+// buildDigest summarizes the catalog over the day before now: backups
+// completed and failed per device, devices offline and storage usage. The
+// caller must hold dataMu.
+func buildDigest(now time.Time) (string, string) {
+	since := now.Add(-24 * time.Hour)
+	type counts struct{ completed, failed, inProgress int }
+	perDevice := map[string]*counts{}
+	for _, device := range devices {
+		perDevice[device.ID] = &counts{}
+	}
+	totalCompleted, totalFailed := 0, 0
+	for _, backup := range backups {
+		c := perDevice[backup.DeviceID]
+		if c == nil || backup.Timestamp.Before(since) || backup.Timestamp.After(now) {
+			continue
+		}
+		switch backup.Status {
+		case "completed":
+			c.completed++
+			totalCompleted++
+		case "failed":
+			c.failed++
+			totalFailed++
+		case "in-progress":
+			c.inProgress++
+		}
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Backup digest for %s to %s\n\n", since.Format("2006-01-02 15:04"), now.Format("2006-01-02 15:04 MST"))
+
+	fmt.Fprintf(&body, "Backups: %d completed, %d failed\n\n", totalCompleted, totalFailed)
+	sorted := append([]Device(nil), devices...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, device := range sorted {
+		c := perDevice[device.ID]
+		line := fmt.Sprintf("  %-24s %3d completed  %3d failed", device.Name, c.completed, c.failed)
+		if c.inProgress > 0 {
+			line += fmt.Sprintf("  %d in progress", c.inProgress)
+		}
+		if c.completed == 0 && c.failed == 0 && c.inProgress == 0 {
+			line += "  (no backups)"
+		}
+		body.WriteString(line + "\n")
+	}
+
+	offline := []string{}
+	for _, device := range sorted {
+		if device.Status == "offline" {
+			offline = append(offline, fmt.Sprintf("  %s, last seen %s", device.Name, device.LastSeen.Format("2006-01-02 15:04")))
+		}
+	}
+	fmt.Fprintf(&body, "\nDevices offline: %d\n", len(offline))
+	for _, line := range offline {
+		body.WriteString(line + "\n")
+	}
+
+	body.WriteString("\nStorage usage:\n")
+	fmt.Fprintf(&body, "  %-24s %s\n", "Server", formatUsage(serverStatus.StorageUsed, serverStatus.StorageTotal))
+	for _, device := range sorted {
+		fmt.Fprintf(&body, "  %-24s %s\n", device.Name, formatUsage(device.StorageUsed, device.StorageTotal))
+	}
+
+	subject := fmt.Sprintf("[IoT Backup] Daily digest: %d completed, %d failed, %d offline", totalCompleted, totalFailed, len(offline))
+	return subject, body.String()
+}
+
+func formatUsage(used, total int64) string {
+	if total <= 0 {
+		return "unknown"
+	}
+	const gb = 1000 * 1000 * 1000
+	return fmt.Sprintf("%.1f / %.1f GB (%.1f%%)", float64(used)/gb, float64(total)/gb, float64(used)*100/float64(total))
+}
+
+// nextDigestTime returns the next occurrence of the "15:04" time of day.
+func nextDigestTime(now time.Time, at string) time.Time {
+	t, _ := time.Parse("15:04", at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// digestRoutine sends the daily digest at the configured time.
+func digestRoutine(cfg *SMTPConfig) {
+	for {
+		time.Sleep(time.Until(nextDigestTime(time.Now(), cfg.DigestTime)))
+		dataMu.Lock()
+		subject, body := buildDigest(time.Now())
+		dataMu.Unlock()
+		if err := sendEmail(cfg, subject, body); err != nil {
+			fmt.Printf("Failed to send daily digest: %s\n", err)
+		}
+	}
+}
+
+// Notification handlers
+func getDigestHandler(w http.ResponseWriter, r *http.Request) {
+	subject, body := buildDigest(time.Now())
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Subject: %s\n\n%s", subject, body)
+}
+
+// sendDigestHandler emails the digest immediately.
+func sendDigestHandler(w http.ResponseWriter, r *http.Request) {
+	if smtpConfig == nil {
+		http.Error(w, "Email notifications are not configured", http.StatusConflict)
+		return
+	}
+	dataMu.Lock()
+	subject, body := buildDigest(time.Now())
+	dataMu.Unlock()
+
+	if err := sendEmail(smtpConfig, subject, body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send digest: %s", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recipients": smtpConfig.To})
+}
+
+// testEmailHandler sends a test message to check the SMTP settings.
+func testEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if smtpConfig == nil {
+		http.Error(w, "Email notifications are not configured", http.StatusConflict)
+		return
+	}
+	if err := sendEmail(smtpConfig, "[IoT Backup] Test message", "Email notifications are working.\n"); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send test email: %s", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recipients": smtpConfig.To})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Event types that webhooks can subscribe to
+const (
+	EventBackupCompleted   = "backup.completed"
+	EventBackupFailed      = "backup.failed"
+	EventDeviceOffline     = "device.offline"
+	EventDeviceOnline      = "device.online"
+	EventStorageThreshold  = "storage.threshold"
+	EventRestoreFinished   = "restore.finished"
+	EventAlertFiring       = "alert.firing"
+	EventAlertResolved     = "alert.resolved"
+	EventReplicationFailed = "replication.failed"
+	EventPing              = "ping"
+)
+
+var eventTypes = []string{
+	EventBackupCompleted,
+	EventBackupFailed,
+	EventDeviceOffline,
+	EventDeviceOnline,
+	EventStorageThreshold,
+	EventRestoreFinished,
+	EventAlertFiring,
+	EventAlertResolved,
+	EventReplicationFailed,
+}
+
+// Event is a notable change, raised alongside the BackupLog entry that
+// records it.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	DeviceID  string                 `json:"deviceId,omitempty"`
+	BackupID  string                 `json:"backupId,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Webhook posts events to an external URL. An empty Events list subscribes
+// to every event type. The secret keys the HMAC signature and is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DeliveryAttempt is one HTTP request made for a delivery.
+type DeliveryAttempt struct {
+	Timestamp  time.Time `json:"timestamp"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// WebhookDelivery tracks sending one event to one webhook.
+type WebhookDelivery struct {
+	ID          string            `json:"id"`
+	WebhookID   string            `json:"webhookId"`
+	EventID     string            `json:"eventId"`
+	EventType   string            `json:"eventType"`
+	URL         string            `json:"url"`
+	Payload     json.RawMessage   `json:"payload"`
+	Status      string            `json:"status"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	CompletedAt *time.Time        `json:"completedAt,omitempty"`
+}
+
+const (
+	webhookMaxAttempts = 6
+	webhookTimeout     = 10 * time.Second
+	webhookHistoryMax  = 1000
+)
+
+// First retry delay; it doubles after every failed attempt.
+var webhookBackoff = 2 * time.Second
+
+var (
+	webhooks      = []Webhook{}
+	nextWebhookID = 1
+	eventSeq      int64
+)
+
+// Delivery history, updated by the delivery goroutines
+var (
+	webhookMu         sync.Mutex
+	webhookDeliveries = []*WebhookDelivery{}
+	deliverySeq       int64
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// emitEvent records entry in the logs and raises an event of the given
+// type for it. The caller must hold dataMu.
+func emitEvent(eventType string, entry BackupLog, data map[string]interface{}) {
+	logs = append(logs, entry)
+
+	eventSeq++
+	event := Event{
+		ID:        fmt.Sprintf("evt-%d", eventSeq),
+		Type:      eventType,
+		Timestamp: entry.Timestamp,
+		Level:     entry.Level,
+		Message:   entry.Message,
+		DeviceID:  entry.DeviceID,
+		BackupID:  entry.BackupID,
+		Data:      data,
+	}
+	for _, hook := range webhooks {
+		if hook.Enabled && hook.subscribes(eventType) {
+			sendWebhook(hook, event)
+		}
+	}
+	notifyEmail(event)
+}
+
+func (hook Webhook) subscribes(eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, t := range hook.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// signPayload returns the X-Webhook-Signature value for a request body.
+// Receivers recompute HMAC-SHA256 over "<timestamp>.<body>" with the shared
+// secret and compare.
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook queues delivery of event to hook and returns the delivery.
+func sendWebhook(hook Webhook, event Event) *WebhookDelivery {
+	payload, _ := json.Marshal(event)
+
+	webhookMu.Lock()
+	deliverySeq++
+	delivery := &WebhookDelivery{
+		ID:        fmt.Sprintf("dlv-%d", deliverySeq),
+		WebhookID: hook.ID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		URL:       hook.URL,
+		Payload:   payload,
+		Status:    "pending",
+		Attempts:  []DeliveryAttempt{},
+		CreatedAt: time.Now(),
+	}
+	webhookDeliveries = append(webhookDeliveries, delivery)
+	if len(webhookDeliveries) > webhookHistoryMax {
+		webhookDeliveries = webhookDeliveries[len(webhookDeliveries)-webhookHistoryMax:]
+	}
+	webhookMu.Unlock()
+
+	go deliverWebhook(hook, delivery, payload)
+	return delivery
+}
+
+// deliverWebhook posts the payload, retrying with exponential backoff until
+// the receiver answers 2xx or the attempts run out.
+func deliverWebhook(hook Webhook, delivery *WebhookDelivery, payload []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		start := time.Now()
+		statusCode, err := postWebhook(hook, delivery, payload)
+		result := DeliveryAttempt{Timestamp: start, StatusCode: statusCode, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		webhookMu.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		done := err == nil || attempt == webhookMaxAttempts
+		if done {
+			delivery.Status = "delivered"
+			if err != nil {
+				delivery.Status = "failed"
+			}
+			now := time.Now()
+			delivery.CompletedAt = &now
+		}
+		webhookMu.Unlock()
+
+		if done {
+			if err != nil {
+				fmt.Printf("Webhook %s gave up on %s after %d attempts: %s\n", hook.ID, delivery.ID, attempt, err)
+			}
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(hook Webhook, delivery *WebhookDelivery, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signPayload(hook.Secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func findWebhook(id string) *Webhook {
+	for i := range webhooks {
+		if webhooks[i].ID == id {
+			return &webhooks[i]
+		}
+	}
+	return nil
+}
+
+func validWebhook(hook *Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url must be an http or https URL")
+	}
+	for _, t := range hook.Events {
+		known := false
+		for _, k := range eventTypes {
+			if t == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	return nil
+}
+
+// redacted returns the webhook without its secret, for listing.
+func (hook Webhook) redacted() Webhook {
+	hook.Secret = ""
+	return hook
+}
+
+// Webhook handlers
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	result := []Webhook{}
+	for _, hook := range webhooks {
+		result = append(result, hook.redacted())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook := findWebhook(mux.Vars(r)["id"])
+	if hook == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook.redacted())
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validWebhook(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hook.ID = fmt.Sprintf("webhook-%d", nextWebhookID)
+	nextWebhookID++
+	hook.CreatedAt = time.Now()
+	webhooks = append(webhooks, hook)
+	setAuditResource(r, "webhook/"+hook.ID)
+
+	// The only response that carries the secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	existing := findWebhook(mux.Vars(r)["id"])
+	if existing == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validWebhook(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hook.ID = existing.ID
+	hook.CreatedAt = existing.CreatedAt
+	if hook.Secret == "" {
+		hook.Secret = existing.Secret
+	}
+	*existing = hook
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook.redacted())
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for i := range webhooks {
+		if webhooks[i].ID == id {
+			webhooks = append(webhooks[:i], webhooks[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Webhook not found", http.StatusNotFound)
+}
+
+// testWebhookHandler sends a ping event to one webhook, enabled or not.
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook := findWebhook(mux.Vars(r)["id"])
+	if hook == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	eventSeq++
+	delivery := sendWebhook(*hook, Event{
+		ID:        fmt.Sprintf("evt-%d", eventSeq),
+		Type:      EventPing,
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   "Webhook test",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"deliveryId": delivery.ID})
+}
+
+// getWebhookDeliveriesHandler lists a webhook's deliveries, newest first,
+// optionally filtered by status (pending, delivered, failed).
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if findWebhook(id) == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	status := r.URL.Query().Get("status")
+
+	webhookMu.Lock()
+	result := []WebhookDelivery{}
+	for i := len(webhookDeliveries) - 1; i >= 0; i-- {
+		d := webhookDeliveries[i]
+		if d.WebhookID != id || (status != "" && d.Status != status) {
+			continue
+		}
+		copied := *d
+		copied.Attempts = append([]DeliveryAttempt(nil), d.Attempts...)
+		result = append(result, copied)
+	}
+	webhookMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var errEntryNotFound = errors.New("entry not found in archive")
+
+// lookupBackupPath resolves a path against a backup's file index and
+// returns the chain links holding its files, for streaming. It writes the
+// error response itself and returns ok=false when the request can't be
+// served.
+func lookupBackupPath(w http.ResponseWriter, r *http.Request) (*chainFiles, IndexEntry, bool) {
+	backupID := mux.Vars(r)["backupId"]
+	p := indexPath(r.URL.Query().Get("path"))
+	auditAccess(r, fmt.Sprintf("backup/%s:%s", backupID, p))
+
+	dataMu.Lock()
+	defer dataMu.Unlock()
+
+	found := findBackup(backupID)
+	if found == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return nil, IndexEntry{}, false
+	}
+	if found.EncryptionKey != "" {
+		http.Error(w, "Backup is end-to-end encrypted; download the archive and decrypt it on the device", http.StatusConflict)
+		return nil, IndexEntry{}, false
+	}
+	idx, err := backupFileIndex(found)
+	if err != nil {
+		fileIndexError(w, backupID, err)
+		return nil, IndexEntry{}, false
+	}
+	entry, ok := idx.files[p]
+	if p == "/" {
+		entry, ok = IndexEntry{Name: "", Path: "/", Type: "dir"}, true
+	}
+	if !ok {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return nil, IndexEntry{}, false
+	}
+	files, err := backupFiles(found)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, IndexEntry{}, false
+	}
+	return files, entry, true
+}
+
+// walkArchive calls fn for every entry of a stored archive until fn returns
+// io.EOF (stop early) or another error.
+func walkArchive(backup *Backup, fn func(hdr *tar.Header, tr *tar.Reader) error) error {
+	reader, err := openArchive(backup)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %s", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Extraction handlers
+func downloadBackupFileHandler(w http.ResponseWriter, r *http.Request) {
+	files, entry, ok := lookupBackupPath(w, r)
+	if !ok {
+		return
+	}
+
+	// Hard links carry no data of their own; stream the file they point at.
+	want := entry.Path
+	switch entry.Type {
+	case "file":
+	case "hardlink":
+		want = indexPath(entry.LinkTarget)
+	case "symlink":
+		http.Error(w, fmt.Sprintf("Path is a symlink to %s", entry.LinkTarget), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Path is not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	// Stream from the chain link that last archived the file.
+	i, ok := files.owner[want]
+	if !ok {
+		http.Error(w, errEntryNotFound.Error(), http.StatusInternalServerError)
+		return
+	}
+	backup := &files.links[i]
+	sent := false
+	err := walkArchive(backup, func(hdr *tar.Header, tr *tar.Reader) error {
+		if hdr.Typeflag != tar.TypeReg || indexPath(hdr.Name) != want {
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(hdr.Size, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(entry.Path)))
+		if entry.SHA256 != "" {
+			w.Header().Set("X-Content-SHA256", entry.SHA256)
+		}
+		sent = true
+		if _, err := io.Copy(w, tr); err != nil {
+			return err
+		}
+		return io.EOF
+	})
+	if !sent && err == nil {
+		err = errEntryNotFound
+	}
+	if err != nil {
+		if sent {
+			fmt.Printf("Failed to send %s from backup %s: %s\n", entry.Path, backup.ID, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func downloadBackupSubtreeHandler(w http.ResponseWriter, r *http.Request) {
+	files, entry, ok := lookupBackupPath(w, r)
+	if !ok {
+		return
+	}
+	if entry.Type != "dir" {
+		http.Error(w, "Path is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	backup := &files.links[len(files.links)-1]
+	name := path.Base(entry.Path)
+	if entry.Path == "/" {
+		name = backup.ID
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, name))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	// Each path comes from the chain link that last archived it, oldest
+	// link first so hard link targets are written before the links.
+	written := map[string]bool{}
+	var err error
+	for i := 0; i < len(files.links) && err == nil; i++ {
+		err = walkArchive(&files.links[i], func(hdr *tar.Header, tr *tar.Reader) error {
+			p := indexPath(hdr.Name)
+			if o, ok := files.owner[p]; !ok || o != i || written[p] {
+				return nil
+			}
+			if entry.Path != "/" && p != entry.Path && !strings.HasPrefix(p, entry.Path+"/") {
+				return nil
+			}
+			// A hard link to a file outside the subtree would dangle.
+			if hdr.Typeflag == tar.TypeLink && !written[indexPath(hdr.Linkname)] {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+			written[p] = true
+			return nil
+		})
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// Headers are already sent. Returning without closing the gzip
+		// stream leaves it without a trailer, so clients see a truncated
+		// archive rather than a valid one.
+		fmt.Printf("Failed to send %s from backup %s: %s\n", entry.Path, backup.ID, err)
+	}
+}
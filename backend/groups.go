@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeviceGroup names a set of devices: the static members plus every device
+// matching the rule, if one is set.
+type DeviceGroup struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Devices []string   `json:"devices"`
+	Rule    *GroupRule `json:"rule,omitempty"`
+}
+
+// GroupRule selects devices dynamically. Type and OSVersion are glob
+// patterns (e.g. "Linux 5.*"); a device must carry all Labels. Empty fields
+// match everything.
+type GroupRule struct {
+	Type      string   `json:"type,omitempty"`
+	OSVersion string   `json:"osVersion,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+}
+
+// BulkResult is the outcome of a bulk operation for one device.
+type BulkResult struct {
+	DeviceID string `json:"deviceId"`
+	Result   string `json:"result"`
+	Message  string `json:"message,omitempty"`
+	BackupID string `json:"backupId,omitempty"`
+}
+
+// BulkSummary is returned by the group bulk endpoints.
+type BulkSummary struct {
+	GroupID   string       `json:"groupId"`
+	Operation string       `json:"operation"`
+	Total     int          `json:"total"`
+	Succeeded int          `json:"succeeded"`
+	Skipped   int          `json:"skipped"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+// Bulk result values
+const (
+	bulkSuccess = "success"
+	bulkSkipped = "skipped"
+	bulkFailure = "failure"
+)
+
+var deviceGroups = []DeviceGroup{}
+var nextGroupID = 1
+
+func findGroup(id string) *DeviceGroup {
+	for i := range deviceGroups {
+		if deviceGroups[i].ID == id {
+			return &deviceGroups[i]
+		}
+	}
+	return nil
+}
+
+func (rule *GroupRule) matches(device Device) bool {
+	if ok, _ := path.Match(rule.Type, device.Type); rule.Type != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(rule.OSVersion, device.OSVersion); rule.OSVersion != "" && !ok {
+		return false
+	}
+	for _, label := range rule.Labels {
+		found := false
+		for _, l := range device.Labels {
+			if l == label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// groupMembers resolves a group to its devices, in device list order.
+func groupMembers(group *DeviceGroup) []*Device {
+	static := map[string]bool{}
+	for _, id := range group.Devices {
+		static[id] = true
+	}
+	members := []*Device{}
+	for i := range devices {
+		if static[devices[i].ID] || (group.Rule != nil && group.Rule.matches(devices[i])) {
+			members = append(members, &devices[i])
+		}
+	}
+	return members
+}
+
+func validGroup(group *DeviceGroup) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return fmt.Errorf("group name is required")
+	}
+	for _, g := range deviceGroups {
+		if g.ID != group.ID && strings.EqualFold(g.Name, group.Name) {
+			return fmt.Errorf("a group named %q already exists", group.Name)
+		}
+	}
+	for _, id := range group.Devices {
+		if findDevice(id) == nil {
+			return fmt.Errorf("device %s not found", id)
+		}
+	}
+	if group.Devices == nil {
+		group.Devices = []string{}
+	}
+	if rule := group.Rule; rule != nil {
+		for _, pattern := range []string{rule.Type, rule.OSVersion} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid rule pattern %q", pattern)
+			}
+		}
+		labels, err := normalizeLabels(rule.Labels)
+		if err != nil {
+			return err
+		}
+		rule.Labels = labels
+	}
+	return nil
+}
+
+// nextScheduleID returns an unused numeric schedule ID.
+func nextScheduleID() string {
+	max := 0
+	for _, schedule := range schedules {
+		if n, err := strconv.Atoi(schedule.ID); err == nil && n > max {
+			max = n
+		}
+	}
+	return strconv.Itoa(max + 1)
+}
+
+// runBulk applies op to every member of the group in the request and writes
+// the per-device summary.
+func runBulk(w http.ResponseWriter, r *http.Request, operation string, op func(device *Device) BulkResult) {
+	group := findGroup(mux.Vars(r)["id"])
+	if group == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	summary := BulkSummary{GroupID: group.ID, Operation: operation, Results: []BulkResult{}}
+	for _, device := range groupMembers(group) {
+		result := op(device)
+		result.DeviceID = device.ID
+		switch result.Result {
+		case bulkSuccess:
+			summary.Succeeded++
+		case bulkSkipped:
+			summary.Skipped++
+		default:
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+	summary.Total = len(summary.Results)
+
+	logs = append(logs, BackupLog{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message: fmt.Sprintf("Bulk %s on group %s: %d succeeded, %d skipped, %d failed",
+			operation, group.Name, summary.Succeeded, summary.Skipped, summary.Failed),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// Group handlers
+func getGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deviceGroups)
+}
+
+func getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group := findGroup(mux.Vars(r)["id"])
+	if group == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func getGroupDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	group := findGroup(mux.Vars(r)["id"])
+	if group == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	members := []Device{}
+	for _, device := range groupMembers(group) {
+		members = append(members, *device)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var group DeviceGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group.ID = fmt.Sprintf("group-%d", nextGroupID)
+	if err := validGroup(&group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nextGroupID++
+	deviceGroups = append(deviceGroups, group)
+	setAuditResource(r, "group/"+group.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+func updateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	existing := findGroup(mux.Vars(r)["id"])
+	if existing == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	var group DeviceGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	group.ID = existing.ID
+	if err := validGroup(&group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	*existing = group
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for i := range deviceGroups {
+		if deviceGroups[i].ID == id {
+			deviceGroups = append(deviceGroups[:i], deviceGroups[i+1:]...)
+			delete(groupQuotas, id)
+			delete(quotaWarned, "group/"+id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Group not found", http.StatusNotFound)
+}
+
+// Bulk operation handlers
+func groupBackupHandler(w http.ResponseWriter, r *http.Request) {
+	runBulk(w, r, "backup", func(device *Device) BulkResult {
+		for _, backup := range backups {
+			if backup.DeviceID == device.ID && backup.Status == "in-progress" {
+				return BulkResult{Result: bulkSkipped, Message: "Backup already in progress", BackupID: backup.ID}
+			}
+		}
+		if device.Status == "offline" {
+			return BulkResult{Result: bulkFailure, Message: "Device is offline"}
+		}
+		backup := startBackup(device)
+		return BulkResult{Result: bulkSuccess, BackupID: backup.ID}
+	})
+}
+
+// groupScheduleHandler applies a schedule template (frequency, time, days,
+// retention, enabled) to every member, creating schedules where missing.
+func groupScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var template BackupSchedule
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if template.Frequency == "" {
+		http.Error(w, "Schedule frequency is required", http.StatusBadRequest)
+		return
+	}
+
+	runBulk(w, r, "schedule", func(device *Device) BulkResult {
+		schedule := findSchedule(device.ID)
+		if schedule == nil {
+			schedules = append(schedules, BackupSchedule{ID: nextScheduleID(), DeviceID: device.ID})
+			schedule = &schedules[len(schedules)-1]
+		}
+		schedule.Frequency = template.Frequency
+		schedule.Time = template.Time
+		schedule.DayOfWeek = template.DayOfWeek
+		schedule.DayOfMonth = template.DayOfMonth
+		schedule.Retention = template.Retention
+		schedule.Enabled = template.Enabled
+		return BulkResult{Result: bulkSuccess, Message: "Schedule " + schedule.ID}
+	})
+}
+
+func setGroupSchedulesEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	operation := "pause"
+	if enabled {
+		operation = "resume"
+	}
+	runBulk(w, r, operation, func(device *Device) BulkResult {
+		schedule := findSchedule(device.ID)
+		if schedule == nil {
+			return BulkResult{Result: bulkSkipped, Message: "Device has no schedule"}
+		}
+		if schedule.Enabled == enabled {
+			return BulkResult{Result: bulkSkipped, Message: "Schedule already in requested state"}
+		}
+		schedule.Enabled = enabled
+		return BulkResult{Result: bulkSuccess}
+	})
+}
+
+func pauseGroupHandler(w http.ResponseWriter, r *http.Request) {
+	setGroupSchedulesEnabled(w, r, false)
+}
+
+func resumeGroupHandler(w http.ResponseWriter, r *http.Request) {
+	setGroupSchedulesEnabled(w, r, true)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockKeyStore is a no-op where flock isn't available; stop the server
+// before running rotate-master-key.
+func lockKeyStore(dir string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockKeyStore takes an exclusive lock on the key store in dir, so a running
+// server and rotate-master-key never rewrite keys.json over each other. The
+// lock is released when the returned file is closed or the process exits.
+func lockKeyStore(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "keys.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key store lock: %s", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errKeyStoreLocked
+		}
+		return nil, fmt.Errorf("failed to lock key store: %s", err)
+	}
+	return f, nil
+}
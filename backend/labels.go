@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxLabels      = 20
+	maxLabelLength = 64
+	maxNotesLength = 4096
+)
+
+// BackupUpdate is the body of PATCH /api/backups/{backupId}. Omitted fields
+// are left unchanged; labels replace the existing set.
+type BackupUpdate struct {
+	Labels *[]string `json:"labels"`
+	Notes  *string   `json:"notes"`
+	Pinned *bool     `json:"pinned"`
+}
+
+// normalizeLabels trims and de-duplicates labels, keeping their order.
+func normalizeLabels(labels []string) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[label] {
+			continue
+		}
+		if len(label) > maxLabelLength {
+			return nil, fmt.Errorf("label %q is longer than %d characters", label, maxLabelLength)
+		}
+		seen[label] = true
+		result = append(result, label)
+	}
+	if len(result) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	return result, nil
+}
+
+func hasLabel(backup Backup, label string) bool {
+	for _, l := range backup.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBackups applies the label (repeatable, all must match) and pinned
+// query filters of the backup list endpoints.
+func filterBackups(list []Backup, r *http.Request) []Backup {
+	q := r.URL.Query()
+	labels := q["label"]
+	pinned, pinnedErr := strconv.ParseBool(q.Get("pinned"))
+
+	filtered := []Backup{}
+	for _, backup := range list {
+		match := true
+		for _, label := range labels {
+			if !hasLabel(backup, label) {
+				match = false
+				break
+			}
+		}
+		if pinnedErr == nil && backup.Pinned != pinned {
+			match = false
+		}
+		if match {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
+}
+
+// Annotation handlers
+func updateBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+
+	backup := findBackup(backupID)
+	if backup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+
+	var update BackupUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var labels []string
+	if update.Labels != nil {
+		var err error
+		if labels, err = normalizeLabels(*update.Labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Notes != nil && len(*update.Notes) > maxNotesLength {
+		http.Error(w, fmt.Sprintf("Notes are longer than %d characters", maxNotesLength), http.StatusBadRequest)
+		return
+	}
+
+	if update.Labels != nil {
+		backup.Labels = labels
+	}
+	if update.Notes != nil {
+		backup.Notes = *update.Notes
+	}
+	if update.Pinned != nil && *update.Pinned != backup.Pinned {
+		backup.Pinned = *update.Pinned
+		message := "Backup pinned"
+		if !backup.Pinned {
+			message = "Backup unpinned"
+		}
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "info",
+			Message:   message,
+			DeviceID:  backup.DeviceID,
+			BackupID:  backup.ID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+// DeviceUpdate is the body of PATCH /api/devices/{deviceId}.
+type DeviceUpdate struct {
+	Labels *[]string `json:"labels"`
+}
+
+func updateDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID := vars["deviceId"]
+
+	device := findDevice(deviceID)
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var update DeviceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Labels != nil {
+		labels, err := normalizeLabels(*update.Labels)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		device.Labels = labels
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
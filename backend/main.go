@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -25,6 +25,11 @@ type Device struct {
 	OSVersion    string    `json:"osVersion"`
 	StorageTotal int64     `json:"storageTotal"`
 	StorageUsed  int64     `json:"storageUsed"`
+	// Outcome of the last sandbox restore test of the device's latest
+	// backup; a failure also puts an online device into "warning".
+	RestoreTestStatus string `json:"restoreTestStatus,omitempty"`
+	// Free-form labels, usable in dynamic device group rules.
+	Labels []string `json:"labels,omitempty"`
 }
 
 type Backup struct {
@@ -38,6 +43,38 @@ type Backup struct {
 	Type       string    `json:"type"`
 	Version    string    `json:"version"`
 	Files      int       `json:"files"`
+	// "full", or "incremental" for a backup holding only the changes since
+	// ParentID.
+	Kind     string `json:"kind,omitempty"`
+	ParentID string `json:"parentId,omitempty"`
+	// A synthetic full backup merges the chain ending at SynthesizedFrom;
+	// that backup then names it in ConsolidatedInto, and incrementals
+	// taken on top of it are parented on the synthetic full instead.
+	SynthesizedFrom  string `json:"synthesizedFrom,omitempty"`
+	ConsolidatedInto string `json:"consolidatedInto,omitempty"`
+	// Fingerprint of the recipient key an agent encrypted the archive to.
+	// Empty unless the backup is end-to-end encrypted, in which case the
+	// server only ever holds ciphertext.
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+	// SHA-256 of the archive as uploaded, and the outcome of the last
+	// integrity check against its manifest.
+	ArchiveSHA256 string     `json:"archiveSha256,omitempty"`
+	VerifyStatus  string     `json:"verifyStatus,omitempty"`
+	VerifiedAt    *time.Time `json:"verifiedAt,omitempty"`
+	// Storage backend holding the archive ("local", "s3", ...).
+	Storage string `json:"storage,omitempty"`
+	// Every known copy of the archive: the device's own, the primary
+	// (Storage) and replicas. Location is derived from these.
+	Copies []ArchiveCopy `json:"copies,omitempty"`
+	// Storage tier of the primary copy: "hot", or "cold" once a tiering
+	// rule has moved it.
+	Tier string `json:"tier,omitempty"`
+	// Chunked archives are stored deduplicated, as a list of chunks.
+	Chunked bool `json:"chunked,omitempty"`
+	// Operator annotations. Pinned backups are never pruned by retention.
+	Labels []string `json:"labels,omitempty"`
+	Notes  string   `json:"notes,omitempty"`
+	Pinned bool     `json:"pinned,omitempty"`
 }
 
 type BackupLog struct {
@@ -72,9 +109,24 @@ type ServerStatus struct {
 	LastBackupTime   *time.Time `json:"lastBackupTime,omitempty"`
 	CPUUsage         int        `json:"cpuUsage"`
 	MemoryUsage      int        `json:"memoryUsage"`
+	// Stored archive bytes per device, computed on request.
+	StorageByDevice []DeviceStorage `json:"storageByDevice"`
+}
+
+// DeviceStorage is one device's share of server storage.
+type DeviceStorage struct {
+	DeviceID   string `json:"deviceId"`
+	DeviceName string `json:"deviceName"`
+	Bytes      int64  `json:"bytes"`
+	Backups    int    `json:"backups"`
 }
 
 // In-memory database (for demo purposes)
+//
+// dataMu guards everything below. Catalog handlers run entirely under it
+// (see withDataLock); handlers and jobs that stream archives hold it only
+// while reading or updating the catalog.
+var dataMu sync.Mutex
 var devices []Device
 var backups []Backup
 var logs []BackupLog
@@ -314,6 +366,14 @@ func timePtr(t time.Time) *time.Time {
 	return &t
 }
 
+func withDataLock(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dataMu.Lock()
+		defer dataMu.Unlock()
+		h(w, r)
+	}
+}
+
 func findDevice(id string) *Device {
 	for i := range devices {
 		if devices[i].ID == id {
@@ -373,10 +433,18 @@ func startBackupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	newBackup := startBackup(device)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBackup)
+}
+
+// startBackup registers a new manual backup of device and logs it.
+func startBackup(device *Device) Backup {
 	// Create a new backup
 	newBackup := Backup{
-		ID:         fmt.Sprintf("backup-%d", time.Now().Unix()),
-		DeviceID:   deviceID,
+		ID:         fmt.Sprintf("backup-%s-%d", device.ID, time.Now().Unix()),
+		DeviceID:   device.ID,
 		DeviceName: device.Name,
 		Timestamp:  time.Now(),
 		Size:       0,
@@ -394,20 +462,18 @@ func startBackupHandler(w http.ResponseWriter, r *http.Request) {
 		Timestamp: time.Now(),
 		Level:     "info",
 		Message:   "Starting backup",
-		DeviceID:  deviceID,
+		DeviceID:  device.ID,
 		BackupID:  newBackup.ID,
 	}
 
 	logs = append(logs, newLog)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(newBackup)
+	return newBackup
 }
 
 // Backup handlers
 func getBackupsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(backups)
+	json.NewEncoder(w).Encode(filterBackups(backups, r))
 }
 
 func getDeviceBackupsHandler(w http.ResponseWriter, r *http.Request) {
@@ -422,7 +488,7 @@ func getDeviceBackupsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(deviceBackups)
+	json.NewEncoder(w).Encode(filterBackups(deviceBackups, r))
 }
 
 func getBackupHandler(w http.ResponseWriter, r *http.Request) {
@@ -530,6 +596,7 @@ func updateScheduleHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	setAuditResource(r, "schedule/"+updatedSchedule.ID)
 
 	scheduleIndex := -1
 	for i, schedule := range schedules {
@@ -558,46 +625,259 @@ func getServerStatusHandler(w http.ResponseWriter, r *http.Request) {
 	serverStatus.CPUUsage = 20 + (serverStatus.CPUUsage % 30)
 	serverStatus.MemoryUsage = 35 + (serverStatus.MemoryUsage % 20)
 
+	serverStatus.StorageByDevice = []DeviceStorage{}
+	for _, device := range devices {
+		used, count := deviceStorage(device.ID, "")
+		serverStatus.StorageByDevice = append(serverStatus.StorageByDevice, DeviceStorage{
+			DeviceID:   device.ID,
+			DeviceName: device.Name,
+			Bytes:      used,
+			Backups:    count,
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(serverStatus)
 }
 
 func main() {
+	// Admin commands
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"rotate-master-key":   rotateMasterKeyCommand,
+			"generate-master-key": generateMasterKeyCommand,
+		}
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatalf("%s: %s", os.Args[1], err)
+		}
+		return
+	}
+
 	// Initialize data
 	initData()
 
+	if err := os.MkdirAll(getArchiveDir(), 0700); err != nil {
+		log.Fatalf("Failed to create archive directory: %s", err)
+	}
+	if err := initKeyStore(getArchiveDir()); err != nil {
+		log.Fatalf("Failed to load encryption keys: %s", err)
+	}
+	if err := openAuditLog(os.Getenv("AUDIT_LOG_FILE")); err != nil {
+		log.Fatalf("Failed to open audit log: %s", err)
+	}
+	if err := initStorage(); err != nil {
+		log.Fatalf("Failed to configure storage: %s", err)
+	}
+	if err := initReplication(); err != nil {
+		log.Fatalf("Failed to configure replication: %s", err)
+	}
+	if err := initTiering(); err != nil {
+		log.Fatalf("Failed to configure tiering: %s", err)
+	}
+	if err := collectChunkGarbage(); err != nil {
+		fmt.Printf("Warning: failed to release unreferenced chunks: %s\n", err)
+	}
+	if !encryptionConfigured() {
+		fmt.Println("Warning: BACKUP_MASTER_KEY not set, archive uploads are disabled")
+	}
+	if err := loadRestoreAssertions(os.Getenv("RESTORE_TEST_ASSERTIONS")); err != nil {
+		log.Fatalf("Failed to load restore assertions: %s", err)
+	}
+	restoreTestInterval, restoreTestsPerDevice, err := restoreTestSettings()
+	if err != nil {
+		log.Fatalf("Failed to configure restore tests: %s", err)
+	}
+	if restoreTestInterval > 0 {
+		go restoreTestRoutine(restoreTestInterval, restoreTestsPerDevice)
+	}
+
+	pruneInterval, err := retentionInterval()
+	if err != nil {
+		log.Fatalf("Failed to configure retention: %s", err)
+	}
+	if pruneInterval > 0 {
+		go retentionRoutine(pruneInterval)
+	}
+
+	offlineAfter, storageThreshold, err := monitorSettings()
+	if err != nil {
+		log.Fatalf("Failed to configure monitoring: %s", err)
+	}
+	go monitorRoutine(offlineAfter, storageThreshold)
+
+	if smtpConfig, err = loadSMTPConfig(); err != nil {
+		log.Fatalf("Failed to configure email notifications: %s", err)
+	}
+	if smtpConfig != nil && smtpConfig.DigestTime != "" {
+		go digestRoutine(smtpConfig)
+	}
+
+	replicateEvery, err := replicationInterval()
+	if err != nil {
+		log.Fatalf("Failed to configure replication: %s", err)
+	}
+	if replicateEvery > 0 {
+		go replicationRoutine(replicateEvery)
+	}
+
+	tierEvery, err := tieringSettings()
+	if err != nil {
+		log.Fatalf("Failed to configure tiering: %s", err)
+	}
+	if tierEvery > 0 {
+		go tieringRoutine(tierEvery)
+	}
+
+	synthesizeEvery, err := syntheticSettings()
+	if err != nil {
+		log.Fatalf("Failed to configure synthetic full backups: %s", err)
+	}
+	if synthesizeEvery > 0 {
+		go syntheticRoutine(synthesizeEvery)
+	}
+
+	alertEvery, err := alertInterval()
+	if err != nil {
+		log.Fatalf("Failed to configure alerts: %s", err)
+	}
+	if alertEvery > 0 {
+		go alertRoutine(alertEvery)
+	}
+
 	// Create router
 	r := mux.NewRouter()
 
 	// API routes
 	// Device routes
-	r.HandleFunc("/api/devices", getDevicesHandler).Methods("GET")
-	r.HandleFunc("/api/devices/{id}", getDeviceHandler).Methods("GET")
-	r.HandleFunc("/api/devices/{deviceId}/backup", startBackupHandler).Methods("POST")
+	r.HandleFunc("/api/devices", withDataLock(getDevicesHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{id}", withDataLock(getDeviceHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}", withDataLock(updateDeviceHandler)).Methods("PATCH")
+	r.HandleFunc("/api/devices/{deviceId}/backup", withDataLock(startBackupHandler)).Methods("POST")
+
+	// Device group routes
+	r.HandleFunc("/api/groups", withDataLock(getGroupsHandler)).Methods("GET")
+	r.HandleFunc("/api/groups", withDataLock(createGroupHandler)).Methods("POST")
+	r.HandleFunc("/api/groups/{id}", withDataLock(getGroupHandler)).Methods("GET")
+	r.HandleFunc("/api/groups/{id}", withDataLock(updateGroupHandler)).Methods("PUT")
+	r.HandleFunc("/api/groups/{id}", withDataLock(deleteGroupHandler)).Methods("DELETE")
+	r.HandleFunc("/api/groups/{id}/devices", withDataLock(getGroupDevicesHandler)).Methods("GET")
+	r.HandleFunc("/api/groups/{id}/backup", withDataLock(groupBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/groups/{id}/schedule", withDataLock(groupScheduleHandler)).Methods("POST")
+	r.HandleFunc("/api/groups/{id}/pause", withDataLock(pauseGroupHandler)).Methods("POST")
+	r.HandleFunc("/api/groups/{id}/resume", withDataLock(resumeGroupHandler)).Methods("POST")
 
 	// Backup routes
-	r.HandleFunc("/api/backups", getBackupsHandler).Methods("GET")
-	r.HandleFunc("/api/devices/{deviceId}/backups", getDeviceBackupsHandler).Methods("GET")
-	r.HandleFunc("/api/backups/{id}", getBackupHandler).Methods("GET")
-	r.HandleFunc("/api/backups/{backupId}/restore", restoreBackupHandler).Methods("POST")
+	r.HandleFunc("/api/backups", withDataLock(getBackupsHandler)).Methods("GET")
+	r.HandleFunc("/api/backups", createBackupHandler).Methods("POST")
+	r.HandleFunc("/api/devices/{deviceId}/backups", withDataLock(getDeviceBackupsHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/restore-plan", getRestorePlanHandler).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/restore-archive", downloadRestoreArchiveHandler).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/restores", withDataLock(reportRestoreHandler)).Methods("POST")
+	r.HandleFunc("/api/devices/{deviceId}/synthetic-full", createSyntheticFullHandler).Methods("POST")
+	r.HandleFunc("/api/synthetic-fulls/run", runSyntheticFullsHandler).Methods("POST")
+	r.HandleFunc("/api/backups/{id}", withDataLock(getBackupHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}", withDataLock(updateBackupHandler)).Methods("PATCH")
+	r.HandleFunc("/api/backups/{backupId}/restore", withDataLock(restoreBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/backups/{backupId}/archive", uploadArchiveHandler).Methods("PUT")
+	r.HandleFunc("/api/backups/{backupId}/archive", downloadArchiveHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/backups/{backupId}/manifest", withDataLock(getManifestHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/chain", withDataLock(getBackupChainHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/verify", verifyBackupHandler).Methods("POST")
+	r.HandleFunc("/api/backups/{backupId}/files", withDataLock(listBackupFilesHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/files/content", downloadBackupFileHandler).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/files/archive", downloadBackupSubtreeHandler).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/diff/{otherId}", diffBackupsHandler).Methods("GET")
 
 	// Log routes
-	r.HandleFunc("/api/logs", getLogsHandler).Methods("GET")
-	r.HandleFunc("/api/devices/{deviceId}/logs", getDeviceLogsHandler).Methods("GET")
-	r.HandleFunc("/api/backups/{backupId}/logs", getBackupLogsHandler).Methods("GET")
+	r.HandleFunc("/api/logs", withDataLock(getLogsHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/logs", withDataLock(getDeviceLogsHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/logs", withDataLock(getBackupLogsHandler)).Methods("GET")
 
 	// Schedule routes
-	r.HandleFunc("/api/schedules", getSchedulesHandler).Methods("GET")
-	r.HandleFunc("/api/devices/{deviceId}/schedule", getDeviceScheduleHandler).Methods("GET")
-	r.HandleFunc("/api/schedules", updateScheduleHandler).Methods("POST")
+	r.HandleFunc("/api/schedules", withDataLock(getSchedulesHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/schedule", withDataLock(getDeviceScheduleHandler)).Methods("GET")
+	r.HandleFunc("/api/schedules", withDataLock(updateScheduleHandler)).Methods("POST")
 
 	// Server status route
-	r.HandleFunc("/api/server/status", getServerStatusHandler).Methods("GET")
+	r.HandleFunc("/api/server/status", withDataLock(getServerStatusHandler)).Methods("GET")
+
+	// Restore test routes
+	r.HandleFunc("/api/restore-tests", withDataLock(getRestoreTestsHandler)).Methods("GET")
+	r.HandleFunc("/api/restore-tests/run", runRestoreTestsHandler).Methods("POST")
+	r.HandleFunc("/api/restore-tests/{id}", withDataLock(getRestoreTestHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/restore-tests", withDataLock(getRestoreTestsHandler)).Methods("GET")
+
+	// Drift routes
+	r.HandleFunc("/api/devices/{deviceId}/drift-rules", withDataLock(getDriftRuleHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/drift-rules", withDataLock(updateDriftRuleHandler)).Methods("PUT")
+	r.HandleFunc("/api/backups/{backupId}/drift", withDataLock(getDriftReportHandler)).Methods("GET")
+
+	// Alert routes
+	r.HandleFunc("/api/alerts", withDataLock(getAlertsHandler)).Methods("GET")
+	r.HandleFunc("/api/alerts/evaluate", withDataLock(evaluateAlertsHandler)).Methods("POST")
+	r.HandleFunc("/api/alert-rules", withDataLock(getAlertRulesHandler)).Methods("GET")
+	r.HandleFunc("/api/alert-rules", withDataLock(createAlertRuleHandler)).Methods("POST")
+	r.HandleFunc("/api/alert-rules/{id}", withDataLock(updateAlertRuleHandler)).Methods("PUT")
+	r.HandleFunc("/api/alert-rules/{id}", withDataLock(deleteAlertRuleHandler)).Methods("DELETE")
+
+	// Webhook routes
+	r.HandleFunc("/api/webhooks", withDataLock(getWebhooksHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks", withDataLock(createWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id}", withDataLock(getWebhookHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks/{id}", withDataLock(updateWebhookHandler)).Methods("PUT")
+	r.HandleFunc("/api/webhooks/{id}", withDataLock(deleteWebhookHandler)).Methods("DELETE")
+	r.HandleFunc("/api/webhooks/{id}/test", withDataLock(testWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id}/deliveries", withDataLock(getWebhookDeliveriesHandler)).Methods("GET")
+
+	// Email notification routes
+	r.HandleFunc("/api/notifications/digest", withDataLock(getDigestHandler)).Methods("GET")
+	r.HandleFunc("/api/notifications/digest", sendDigestHandler).Methods("POST")
+	r.HandleFunc("/api/notifications/test", testEmailHandler).Methods("POST")
+
+	// Storage routes
+	r.HandleFunc("/api/storage", getStorageHandler).Methods("GET")
+
+	// Replication routes
+	r.HandleFunc("/api/replication-policies", withDataLock(getReplicationPoliciesHandler)).Methods("GET")
+	r.HandleFunc("/api/replication-policies", withDataLock(createReplicationPolicyHandler)).Methods("POST")
+	r.HandleFunc("/api/replication-policies/{id}", withDataLock(updateReplicationPolicyHandler)).Methods("PUT")
+	r.HandleFunc("/api/replication-policies/{id}", withDataLock(deleteReplicationPolicyHandler)).Methods("DELETE")
+	r.HandleFunc("/api/backups/{backupId}/replicate", replicateBackupHandler).Methods("POST")
+	r.HandleFunc("/api/reports/3-2-1", withDataLock(get321ReportHandler)).Methods("GET")
+
+	// Quota routes
+	r.HandleFunc("/api/devices/{deviceId}/quota", withDataLock(getDeviceQuotaHandler)).Methods("GET")
+	r.HandleFunc("/api/devices/{deviceId}/quota", withDataLock(updateDeviceQuotaHandler)).Methods("PUT")
+	r.HandleFunc("/api/devices/{deviceId}/quota", withDataLock(deleteDeviceQuotaHandler)).Methods("DELETE")
+	r.HandleFunc("/api/groups/{id}/quota", withDataLock(getGroupQuotaHandler)).Methods("GET")
+	r.HandleFunc("/api/groups/{id}/quota", withDataLock(updateGroupQuotaHandler)).Methods("PUT")
+	r.HandleFunc("/api/groups/{id}/quota", withDataLock(deleteGroupQuotaHandler)).Methods("DELETE")
+	r.HandleFunc("/api/quotas/usage", withDataLock(getQuotaUsageHandler)).Methods("GET")
+
+	// Dedup routes
+	r.HandleFunc("/api/dedup/stats", withDataLock(getDedupStatsHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{backupId}/chunks", withDataLock(getBackupChunksHandler)).Methods("GET")
+
+	// Tiering routes
+	r.HandleFunc("/api/tiering-rules", withDataLock(getTieringRulesHandler)).Methods("GET")
+	r.HandleFunc("/api/tiering-rules", withDataLock(createTieringRuleHandler)).Methods("POST")
+	r.HandleFunc("/api/tiering-rules/{id}", withDataLock(updateTieringRuleHandler)).Methods("PUT")
+	r.HandleFunc("/api/tiering-rules/{id}", withDataLock(deleteTieringRuleHandler)).Methods("DELETE")
+	r.HandleFunc("/api/tiering/run", runTieringHandler).Methods("POST")
+
+	// Audit routes
+	r.HandleFunc("/api/audit", getAuditHandler).Methods("GET")
+	r.HandleFunc("/api/audit/verify", verifyAuditHandler).Methods("GET")
+	r.Use(auditMiddleware)
 
 	// Set up CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
 	})
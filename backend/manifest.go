@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ManifestEntry describes one entry of a backup archive.
+type ManifestEntry struct {
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Mode       int64     `json:"mode"`
+	ModTime    time.Time `json:"mtime"`
+	SHA256     string    `json:"sha256,omitempty"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
+// Manifest lists every file in a backup plus a hash of the whole archive as
+// uploaded (for end-to-end encrypted backups that is the ciphertext). An
+// incremental backup's manifest lists only what changed since its parent,
+// and Deleted names the paths removed since then.
+//
+// An end-to-end encrypted backup's manifest carries no paths or file hashes:
+// the agent seals its file list to the device's recipient key instead, and
+// the server keeps that opaque for the agent to read back when restoring.
+type Manifest struct {
+	ArchiveSHA256 string          `json:"archiveSha256"`
+	Entries       []ManifestEntry `json:"entries"`
+	Deleted       []string        `json:"deleted,omitempty"`
+	Sealed        string          `json:"sealed,omitempty"`
+}
+
+// errSealedManifest is returned where a backup's file list is needed but the
+// backup is end-to-end encrypted.
+var errSealedManifest = errors.New("file list of an end-to-end encrypted backup is only readable on the device")
+
+// VerifyResult is the outcome of checking a stored archive against its
+// manifest.
+type VerifyResult struct {
+	BackupID     string    `json:"backupId"`
+	Status       string    `json:"status"`
+	CheckedAt    time.Time `json:"checkedAt"`
+	FilesChecked int       `json:"filesChecked"`
+	Errors       []string  `json:"errors,omitempty"`
+}
+
+// Manifests by backup ID
+var manifests = map[string]*Manifest{}
+
+// verifyErrorLimit caps how many mismatches a verification reports.
+const verifyErrorLimit = 50
+
+func entryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return "other"
+	}
+}
+
+// readManifestEntries walks a tar.gz stream, hashing every regular file.
+func readManifestEntries(r io.Reader) ([]ManifestEntry, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %s", err)
+	}
+	defer gz.Close()
+
+	entries := []ManifestEntry{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("failed to read archive: %s", err)
+		}
+		entry := ManifestEntry{
+			Path:       hdr.Name,
+			Type:       entryType(hdr.Typeflag),
+			Size:       hdr.Size,
+			Mode:       hdr.Mode,
+			ModTime:    hdr.ModTime,
+			LinkTarget: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return entries, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+			}
+			entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// buildManifest creates a manifest from a stored archive, for backups whose
+// agent didn't supply one.
+func buildManifest(backup *Backup) (*Manifest, error) {
+	reader, err := openArchive(backup)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	entries, err := readManifestEntries(io.TeeReader(reader, h))
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(h, reader)
+	return &Manifest{ArchiveSHA256: hex.EncodeToString(h.Sum(nil)), Entries: entries}, nil
+}
+
+func compareEntry(want, got ManifestEntry) string {
+	switch {
+	case want.Type != got.Type:
+		return fmt.Sprintf("%s: type %s, manifest says %s", got.Path, got.Type, want.Type)
+	case want.Size != got.Size:
+		return fmt.Sprintf("%s: size %d, manifest says %d", got.Path, got.Size, want.Size)
+	case want.Mode != got.Mode:
+		return fmt.Sprintf("%s: mode %o, manifest says %o", got.Path, got.Mode, want.Mode)
+	case !want.ModTime.Equal(got.ModTime):
+		return fmt.Sprintf("%s: mtime %s, manifest says %s", got.Path, got.ModTime.Format(time.RFC3339), want.ModTime.Format(time.RFC3339))
+	case want.SHA256 != got.SHA256:
+		return fmt.Sprintf("%s: sha256 %s, manifest says %s", got.Path, got.SHA256, want.SHA256)
+	}
+	return ""
+}
+
+// verifyArchive recomputes the archive hash and, unless the backup is
+// end-to-end encrypted, every file hash, and compares them to the manifest.
+func verifyArchive(backup *Backup, manifest *Manifest) VerifyResult {
+	result := VerifyResult{BackupID: backup.ID, CheckedAt: time.Now()}
+	fail := func(msg string) {
+		if len(result.Errors) < verifyErrorLimit {
+			result.Errors = append(result.Errors, msg)
+		}
+	}
+
+	reader, err := openArchive(backup)
+	if err != nil {
+		fail(fmt.Sprintf("failed to open archive: %s", err))
+		result.Status = "failed"
+		return result
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if backup.EncryptionKey == "" {
+		got, err := readManifestEntries(io.TeeReader(reader, h))
+		if err != nil {
+			fail(err.Error())
+		}
+		expected := map[string]ManifestEntry{}
+		for _, entry := range manifest.Entries {
+			expected[entry.Path] = entry
+		}
+		for _, entry := range got {
+			result.FilesChecked++
+			want, ok := expected[entry.Path]
+			if !ok {
+				fail(fmt.Sprintf("%s: not in manifest", entry.Path))
+				continue
+			}
+			delete(expected, entry.Path)
+			if msg := compareEntry(want, entry); msg != "" {
+				fail(msg)
+			}
+		}
+		// A read error already explains why later entries are missing.
+		if err == nil {
+			for path := range expected {
+				fail(fmt.Sprintf("%s: missing from archive", path))
+			}
+		}
+	}
+	if _, err := io.Copy(h, reader); err != nil {
+		fail(fmt.Sprintf("failed to read archive: %s", err))
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != manifest.ArchiveSHA256 {
+		fail(fmt.Sprintf("archive sha256 %s, manifest says %s", sum, manifest.ArchiveSHA256))
+	}
+
+	result.Status = "passed"
+	if len(result.Errors) > 0 {
+		result.Status = "failed"
+	}
+	return result
+}
+
+// Manifest handlers
+func getManifestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+
+	manifest, ok := manifests[backupID]
+	if !ok {
+		http.Error(w, "Manifest not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+func verifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backupID := vars["backupId"]
+
+	dataMu.Lock()
+	found := findBackup(backupID)
+	var backup Backup
+	if found != nil {
+		backup = *found
+	}
+	manifest, hasManifest := manifests[backupID]
+	dataMu.Unlock()
+
+	if found == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	if !hasManifest {
+		http.Error(w, "Backup has no manifest", http.StatusConflict)
+		return
+	}
+	if !archiveExists(&backup) {
+		http.Error(w, "Archive not stored on server", http.StatusNotFound)
+		return
+	}
+
+	result := verifyArchive(&backup, manifest)
+	recordVerifyResult(backup.DeviceID, result)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// recordVerifyResult stores a verification outcome on the backup and logs
+// it. The caller must not hold dataMu.
+func recordVerifyResult(deviceID string, result VerifyResult) {
+	dataMu.Lock()
+	defer dataMu.Unlock()
+
+	if backup := findBackup(result.BackupID); backup != nil {
+		backup.VerifyStatus = result.Status
+		backup.VerifiedAt = timePtr(result.CheckedAt)
+	}
+	level, message := "info", "Backup verification passed"
+	if result.Status != "passed" {
+		level = "error"
+		message = fmt.Sprintf("Backup verification failed: %d problem(s)", len(result.Errors))
+	}
+	logs = append(logs, BackupLog{
+		Timestamp: result.CheckedAt,
+		Level:     level,
+		Message:   message,
+		DeviceID:  deviceID,
+		BackupID:  result.BackupID,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const monitorInterval = time.Minute
+
+// Storage usage (keyed "server" or "device/<id>") currently above the alert
+// threshold, so each crossing is reported once.
+var storageAlerted = map[string]bool{}
+
+// touchDevice records contact from a device agent, bringing an offline
+// device back online. The caller must hold dataMu.
+func touchDevice(deviceID string) {
+	device := findDevice(deviceID)
+	if device == nil {
+		return
+	}
+	device.LastSeen = time.Now()
+	if device.Status == "offline" {
+		device.Status = "online"
+		emitEvent(EventDeviceOnline, BackupLog{
+			Timestamp: device.LastSeen,
+			Level:     "info",
+			Message:   "Device back online",
+			DeviceID:  deviceID,
+		}, nil)
+	}
+}
+
+// checkDevices marks devices that haven't been seen within offlineAfter as
+// offline. The caller must hold dataMu.
+func checkDevices(now time.Time, offlineAfter time.Duration) {
+	for i := range devices {
+		device := &devices[i]
+		if device.Status == "offline" || now.Sub(device.LastSeen) < offlineAfter {
+			continue
+		}
+		device.Status = "offline"
+		emitEvent(EventDeviceOffline, BackupLog{
+			Timestamp: now,
+			Level:     "warning",
+			Message:   fmt.Sprintf("Device offline, last seen %s", device.LastSeen.Format(time.RFC3339)),
+			DeviceID:  device.ID,
+		}, map[string]interface{}{"lastSeen": device.LastSeen})
+	}
+}
+
+// checkStorage raises an event when server or device storage usage crosses
+// threshold percent. The caller must hold dataMu.
+func checkStorage(now time.Time, threshold float64) {
+	check := func(key, deviceID, name string, used, total int64) {
+		if total <= 0 {
+			return
+		}
+		percent := float64(used) * 100 / float64(total)
+		if percent < threshold {
+			delete(storageAlerted, key)
+			return
+		}
+		if storageAlerted[key] {
+			return
+		}
+		storageAlerted[key] = true
+		emitEvent(EventStorageThreshold, BackupLog{
+			Timestamp: now,
+			Level:     "warning",
+			Message:   fmt.Sprintf("%s storage at %.1f%% (threshold %.0f%%)", name, percent, threshold),
+			DeviceID:  deviceID,
+		}, map[string]interface{}{"storageUsed": used, "storageTotal": total, "percent": percent})
+	}
+
+	check("server", "", "Server", serverStatus.StorageUsed, serverStatus.StorageTotal)
+	for _, device := range devices {
+		check("device/"+device.ID, device.ID, "Device", device.StorageUsed, device.StorageTotal)
+	}
+}
+
+// monitorRoutine periodically checks device liveness and storage usage.
+func monitorRoutine(offlineAfter time.Duration, threshold float64) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dataMu.Lock()
+		now := time.Now()
+		checkDevices(now, offlineAfter)
+		checkStorage(now, threshold)
+		dataMu.Unlock()
+	}
+}
+
+func monitorSettings() (time.Duration, float64, error) {
+	offlineAfter := time.Hour
+	if v := os.Getenv("DEVICE_OFFLINE_AFTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid DEVICE_OFFLINE_AFTER: %s", v)
+		}
+		offlineAfter = d
+	}
+	threshold := 90.0
+	if v := os.Getenv("STORAGE_ALERT_THRESHOLD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 100 {
+			return 0, 0, fmt.Errorf("invalid STORAGE_ALERT_THRESHOLD: %s", v)
+		}
+		threshold = f
+	}
+	return offlineAfter, threshold, nil
+}
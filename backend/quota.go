@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Quota limits the stored archives of a device, or of all members of a
+// group together. Zero limits are unlimited. Uploads that would exceed a
+// limit are rejected; crossing SoftLimitPercent of either limit logs a
+// warning.
+type Quota struct {
+	MaxBytes         int64   `json:"maxBytes,omitempty"`
+	MaxBackups       int     `json:"maxBackups,omitempty"`
+	SoftLimitPercent float64 `json:"softLimitPercent,omitempty"`
+}
+
+const defaultSoftLimitPercent = 80
+
+// QuotaUsage is a device's or group's consumption against its quota.
+type QuotaUsage struct {
+	Scope     string  `json:"scope"`
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Quota     *Quota  `json:"quota,omitempty"`
+	UsedBytes int64   `json:"usedBytes"`
+	Backups   int     `json:"backups"`
+	Percent   float64 `json:"percent"`
+	State     string  `json:"state"`
+}
+
+// Quota states
+const (
+	QuotaOK       = "ok"
+	QuotaSoft     = "soft-limit"
+	QuotaExceeded = "exceeded"
+)
+
+var (
+	deviceQuotas = map[string]Quota{}
+	groupQuotas  = map[string]Quota{}
+	// Scopes ("device/<id>", "group/<id>") currently over their soft limit,
+	// so the warning is logged once per crossing.
+	quotaWarned = map[string]bool{}
+)
+
+func validQuota(quota *Quota) error {
+	if quota.MaxBytes < 0 || quota.MaxBackups < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if quota.MaxBytes == 0 && quota.MaxBackups == 0 {
+		return fmt.Errorf("at least one of maxBytes and maxBackups is required")
+	}
+	if quota.SoftLimitPercent == 0 {
+		quota.SoftLimitPercent = defaultSoftLimitPercent
+	}
+	if quota.SoftLimitPercent < 0 || quota.SoftLimitPercent > 100 {
+		return fmt.Errorf("softLimitPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// deviceStorage sums the archives stored for a device, on any tier. The
+// backup named by exclude is left out so re-uploads aren't counted twice.
+func deviceStorage(deviceID, exclude string) (int64, int) {
+	var used int64
+	count := 0
+	for _, backup := range backups {
+		if backup.DeviceID != deviceID || backup.ID == exclude || backup.Storage == "" {
+			continue
+		}
+		used += backup.Size
+		count++
+	}
+	return used, count
+}
+
+// quotaScope is one quota that applies to a device.
+type quotaScope struct {
+	scope   string
+	id      string
+	name    string
+	quota   Quota
+	devices []string
+}
+
+// deviceQuotaScopes returns the device's own quota and those of every group
+// it belongs to.
+func deviceQuotaScopes(deviceID string) []quotaScope {
+	scopes := []quotaScope{}
+	if quota, ok := deviceQuotas[deviceID]; ok {
+		name := deviceID
+		if device := findDevice(deviceID); device != nil {
+			name = device.Name
+		}
+		scopes = append(scopes, quotaScope{"device", deviceID, name, quota, []string{deviceID}})
+	}
+	for i := range deviceGroups {
+		group := &deviceGroups[i]
+		quota, ok := groupQuotas[group.ID]
+		if !ok {
+			continue
+		}
+		members := []string{}
+		covered := false
+		for _, member := range groupMembers(group) {
+			members = append(members, member.ID)
+			covered = covered || member.ID == deviceID
+		}
+		if covered {
+			scopes = append(scopes, quotaScope{"group", group.ID, group.Name, quota, members})
+		}
+	}
+	return scopes
+}
+
+func (s quotaScope) usage(exclude string) (int64, int) {
+	var used int64
+	count := 0
+	for _, id := range s.devices {
+		b, n := deviceStorage(id, exclude)
+		used += b
+		count += n
+	}
+	return used, count
+}
+
+// checkQuota returns why storing incoming more bytes as backupID would
+// break one of the device's quotas, or "" if it fits. The caller must hold
+// dataMu.
+func checkQuota(deviceID, backupID string, incoming int64) string {
+	for _, s := range deviceQuotaScopes(deviceID) {
+		used, count := s.usage(backupID)
+		if s.quota.MaxBytes > 0 && used+incoming > s.quota.MaxBytes {
+			return fmt.Sprintf("%s %q storage quota exceeded: %d bytes stored + %d incoming > %d allowed",
+				s.scope, s.name, used, incoming, s.quota.MaxBytes)
+		}
+		if s.quota.MaxBackups > 0 && count+1 > s.quota.MaxBackups {
+			return fmt.Sprintf("%s %q backup quota exceeded: %d backups stored, %d allowed",
+				s.scope, s.name, count, s.quota.MaxBackups)
+		}
+	}
+	return ""
+}
+
+func quotaPercent(quota Quota, used int64, count int) float64 {
+	percent := 0.0
+	if quota.MaxBytes > 0 {
+		percent = float64(used) * 100 / float64(quota.MaxBytes)
+	}
+	if quota.MaxBackups > 0 {
+		if p := float64(count) * 100 / float64(quota.MaxBackups); p > percent {
+			percent = p
+		}
+	}
+	return percent
+}
+
+func quotaState(quota Quota, percent float64) string {
+	switch {
+	case percent > 100:
+		return QuotaExceeded
+	case percent >= quota.SoftLimitPercent:
+		return QuotaSoft
+	}
+	return QuotaOK
+}
+
+// warnQuotas raises a storage threshold event for each of a device's quotas
+// that has just crossed its soft limit. The caller must hold dataMu.
+func warnQuotas(deviceID, backupID string) {
+	for _, s := range deviceQuotaScopes(deviceID) {
+		used, count := s.usage("")
+		percent := quotaPercent(s.quota, used, count)
+		key := s.scope + "/" + s.id
+		if percent < s.quota.SoftLimitPercent {
+			delete(quotaWarned, key)
+			continue
+		}
+		if quotaWarned[key] {
+			continue
+		}
+		quotaWarned[key] = true
+		emitEvent(EventStorageThreshold, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message: fmt.Sprintf("%s %q is at %.0f%% of its quota (%d bytes, %d backups stored)",
+				s.scope, s.name, percent, used, count),
+			DeviceID: deviceID,
+			BackupID: backupID,
+		}, map[string]interface{}{"quotaScope": s.scope, "quotaId": s.id, "storageUsed": used, "backups": count, "percent": percent})
+	}
+}
+
+// Quota handlers
+func getDeviceQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	quota, ok := deviceQuotas[deviceID]
+	if !ok {
+		http.Error(w, "Device has no quota", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quota)
+}
+
+func updateDeviceQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	var quota Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validQuota(&quota); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceQuotas[deviceID] = quota
+	delete(quotaWarned, "device/"+deviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quota)
+}
+
+func deleteDeviceQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if _, ok := deviceQuotas[deviceID]; !ok {
+		http.Error(w, "Device has no quota", http.StatusNotFound)
+		return
+	}
+	delete(deviceQuotas, deviceID)
+	delete(quotaWarned, "device/"+deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getGroupQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if findGroup(id) == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	quota, ok := groupQuotas[id]
+	if !ok {
+		http.Error(w, "Group has no quota", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quota)
+}
+
+func updateGroupQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if findGroup(id) == nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	var quota Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validQuota(&quota); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupQuotas[id] = quota
+	delete(quotaWarned, "group/"+id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quota)
+}
+
+func deleteGroupQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := groupQuotas[id]; !ok {
+		http.Error(w, "Group has no quota", http.StatusNotFound)
+		return
+	}
+	delete(groupQuotas, id)
+	delete(quotaWarned, "group/"+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getQuotaUsageHandler reports usage for every device, and for every group
+// with a quota. ?state= filters by quota state.
+func getQuotaUsageHandler(w http.ResponseWriter, r *http.Request) {
+	result := []QuotaUsage{}
+	add := func(usage QuotaUsage, quota Quota, hasQuota bool) {
+		if hasQuota {
+			usage.Quota = &quota
+			usage.Percent = quotaPercent(quota, usage.UsedBytes, usage.Backups)
+			usage.State = quotaState(quota, usage.Percent)
+		} else {
+			usage.State = QuotaOK
+		}
+		if v := r.URL.Query().Get("state"); v != "" && usage.State != v {
+			return
+		}
+		result = append(result, usage)
+	}
+
+	for _, device := range devices {
+		used, count := deviceStorage(device.ID, "")
+		quota, ok := deviceQuotas[device.ID]
+		add(QuotaUsage{Scope: "device", ID: device.ID, Name: device.Name, UsedBytes: used, Backups: count}, quota, ok)
+	}
+	ids := []string{}
+	for id := range groupQuotas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		group := findGroup(id)
+		if group == nil {
+			continue
+		}
+		usage := QuotaUsage{Scope: "group", ID: id, Name: group.Name}
+		for _, member := range groupMembers(group) {
+			used, count := deviceStorage(member.ID, "")
+			usage.UsedBytes += used
+			usage.Backups += count
+		}
+		add(usage, groupQuotas[id], true)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
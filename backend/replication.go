@@ -0,0 +1,670 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ArchiveCopy is one copy of a backup's archive. Target is a storage backend
+// name, or "device" for the copy the agent keeps. SHA256 is the plaintext
+// hash read back from the copy, which must match the backup's ArchiveSHA256
+// for the copy to count as verified.
+type ArchiveCopy struct {
+	Target     string     `json:"target"`
+	Status     string     `json:"status"`
+	SHA256     string     `json:"sha256,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Attempts   int        `json:"attempts,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+}
+
+// Copy statuses. A device copy is only ever "reported": the server can't
+// read it back.
+const (
+	CopyPending  = "pending"
+	CopyCopying  = "copying"
+	CopyVerified = "verified"
+	CopyFailed   = "failed"
+	CopyReported = "reported"
+	CopyUnknown  = "unknown"
+)
+
+const deviceCopyTarget = "device"
+
+// replicationMaxAttempts bounds automatic retries of a failed copy; a manual
+// replicate request starts over.
+const replicationMaxAttempts = 5
+
+// ReplicationPolicy copies the archives of DeviceID, or of the members of
+// GroupID, or of every device when both are empty, to each of Targets.
+type ReplicationPolicy struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Targets  []string `json:"targets"`
+	DeviceID string   `json:"deviceId,omitempty"`
+	GroupID  string   `json:"groupId,omitempty"`
+	Enabled  bool     `json:"enabled"`
+}
+
+var (
+	replicationPolicies   = []ReplicationPolicy{}
+	nextReplicationID     = 1
+	offsiteTargets        = map[string]bool{"s3": true}
+	replicationInProgress = map[string]bool{}
+)
+
+// initReplication registers the storage targets listed in
+// REPLICATION_TARGETS (same syntax as STORAGE_BACKEND) and, when there are
+// any, a default policy replicating every device to them. REPLICATION_OFFSITE
+// names the targets that count as offsite for the 3-2-1 report; it defaults
+// to "s3".
+func initReplication() error {
+	targets := []string{}
+	for _, spec := range strings.Split(os.Getenv("REPLICATION_TARGETS"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		store, err := registerStorage(spec)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, store.Name())
+	}
+	if len(targets) > 0 {
+		replicationPolicies = append(replicationPolicies, ReplicationPolicy{
+			ID:      fmt.Sprintf("%d", nextReplicationID),
+			Name:    "Default",
+			Targets: targets,
+			Enabled: true,
+		})
+		nextReplicationID++
+	}
+
+	if v, ok := os.LookupEnv("REPLICATION_OFFSITE"); ok {
+		offsiteTargets = map[string]bool{}
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				offsiteTargets[name] = true
+			}
+		}
+	}
+	return nil
+}
+
+func validReplicationPolicy(policy *ReplicationPolicy) error {
+	if policy.Name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+	if len(policy.Targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+	seen := map[string]bool{}
+	for _, target := range policy.Targets {
+		if _, ok := storageBackends[target]; !ok {
+			return fmt.Errorf("storage target %q is not configured", target)
+		}
+		if seen[target] {
+			return fmt.Errorf("duplicate target %q", target)
+		}
+		seen[target] = true
+	}
+	if policy.DeviceID != "" && findDevice(policy.DeviceID) == nil {
+		return fmt.Errorf("device %s not found", policy.DeviceID)
+	}
+	if policy.GroupID != "" && findGroup(policy.GroupID) == nil {
+		return fmt.Errorf("group %s not found", policy.GroupID)
+	}
+	return nil
+}
+
+func findReplicationPolicy(id string) *ReplicationPolicy {
+	for i := range replicationPolicies {
+		if replicationPolicies[i].ID == id {
+			return &replicationPolicies[i]
+		}
+	}
+	return nil
+}
+
+// scopeCovers reports whether a device falls in a rule's scope: scopeDevice,
+// or the members of scopeGroup, or every device when both are empty.
+func scopeCovers(scopeDevice, scopeGroup, deviceID string) bool {
+	if scopeDevice != "" {
+		return scopeDevice == deviceID
+	}
+	if scopeGroup != "" {
+		group := findGroup(scopeGroup)
+		if group == nil {
+			return false
+		}
+		for _, member := range groupMembers(group) {
+			if member.ID == deviceID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func findCopy(backup *Backup, target string) *ArchiveCopy {
+	for i := range backup.Copies {
+		if backup.Copies[i].Target == target {
+			return &backup.Copies[i]
+		}
+	}
+	return nil
+}
+
+// planReplicas adds a pending copy for every policy target the backup isn't
+// on yet, and reports whether anything is left to copy. The caller must hold
+// dataMu.
+func planReplicas(backup *Backup) bool {
+	if backup.Status != "completed" || backup.Storage == "" {
+		return false
+	}
+	for _, policy := range replicationPolicies {
+		if !policy.Enabled || !scopeCovers(policy.DeviceID, policy.GroupID, backup.DeviceID) {
+			continue
+		}
+		for _, target := range policy.Targets {
+			if findCopy(backup, target) == nil {
+				backup.Copies = append(backup.Copies, ArchiveCopy{Target: target, Status: CopyPending})
+			}
+		}
+	}
+	for _, c := range backup.Copies {
+		if c.Status == CopyPending || (c.Status == CopyFailed && c.Attempts < replicationMaxAttempts) {
+			return true
+		}
+	}
+	return false
+}
+
+// backupCopies returns a backup's copies. Backups recorded before copies
+// were tracked only have Location to go on, so their server copy is of
+// unknown state.
+func backupCopies(backup *Backup) []ArchiveCopy {
+	if len(backup.Copies) > 0 {
+		return backup.Copies
+	}
+	copies := []ArchiveCopy{}
+	if backup.Location == "local" || backup.Location == "both" {
+		copies = append(copies, ArchiveCopy{Target: deviceCopyTarget, Status: CopyReported})
+	}
+	if backup.Location == "server" || backup.Location == "both" {
+		target := backup.Storage
+		if target == "" {
+			target = "local"
+		}
+		copies = append(copies, ArchiveCopy{Target: target, Status: CopyUnknown})
+	}
+	return copies
+}
+
+// archiveLocation derives Location from the copies that actually exist:
+// "local" for the device's copy, "server" for a verified server-side copy,
+// "both" for both. The device's copy is as the agent reported it; nothing
+// that needs a verified copy, such as the 3-2-1 report, relies on it.
+func archiveLocation(backup *Backup) string {
+	device, server := false, false
+	for _, c := range backupCopies(backup) {
+		switch {
+		case c.Target == deviceCopyTarget:
+			device = true
+		case c.Status == CopyVerified:
+			server = true
+		}
+	}
+	switch {
+	case device && server:
+		return "both"
+	case server:
+		return "server"
+	case device:
+		return "local"
+	}
+	return ""
+}
+
+// copyArchive copies a stored archive's ciphertext between backends and
+// returns the plaintext hash and size read back from the new copy.
+func copyArchive(backup *Backup, from, to Storage) (string, int64, error) {
+	if backup.Chunked {
+		index := backupChunkIndex(backup.ID)
+		if index == nil {
+			return "", 0, ErrObjectNotFound
+		}
+		if err := copyChunks(index.Chunks, from, to); err != nil {
+			return "", 0, err
+		}
+	} else if err := copyArchiveObject(backup, from, to); err != nil {
+		return "", 0, err
+	}
+	return hashArchiveOn(backup, to)
+}
+
+// hashArchiveOn reads back the copy of a backup's archive held by store and
+// returns its sha256 and size.
+func hashArchiveOn(backup *Backup, store Storage) (string, int64, error) {
+	reader, err := openArchiveOn(backup, store)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open copy: %s", err)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return "", n, fmt.Errorf("failed to read back copy: %s", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func copyArchiveObject(backup *Backup, from, to Storage) error {
+	key := archiveKey(backup)
+	info, err := from.Stat(key)
+	if err != nil {
+		return fmt.Errorf("failed to stat source: %s", err)
+	}
+	src, err := from.Get(key, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %s", err)
+	}
+	err = to.Put(key, src, info.Size)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write copy: %s", err)
+	}
+	return nil
+}
+
+// replicateBackup copies a backup's archive to each pending or retryable
+// target and verifies every copy by reading it back. Archive I/O runs
+// without dataMu; the caller must not hold it.
+func replicateBackup(backupID string, force bool) {
+	dataMu.Lock()
+	backup := findBackup(backupID)
+	if backup == nil || replicationInProgress[backupID] {
+		dataMu.Unlock()
+		return
+	}
+	if force {
+		for i := range backup.Copies {
+			if backup.Copies[i].Status == CopyFailed {
+				backup.Copies[i].Attempts = 0
+			}
+		}
+	}
+	if !planReplicas(backup) {
+		dataMu.Unlock()
+		return
+	}
+	replicationInProgress[backupID] = true
+	snapshot := *backup
+	snapshot.Copies = append([]ArchiveCopy(nil), backup.Copies...)
+	dataMu.Unlock()
+
+	defer func() {
+		dataMu.Lock()
+		delete(replicationInProgress, backupID)
+		dataMu.Unlock()
+	}()
+
+	from, err := storageFor(&snapshot)
+	for _, c := range snapshot.Copies {
+		if c.Status != CopyPending && (c.Status != CopyFailed || c.Attempts >= replicationMaxAttempts) {
+			continue
+		}
+		setCopyStatus(backupID, c.Target, CopyCopying)
+
+		var sum string
+		var n int64
+		copyErr := err
+		if copyErr == nil {
+			to, ok := storageBackends[c.Target]
+			if !ok {
+				copyErr = fmt.Errorf("storage target %q is not configured", c.Target)
+			} else {
+				sum, n, copyErr = copyArchive(&snapshot, from, to)
+			}
+		}
+		if copyErr == nil && snapshot.ArchiveSHA256 != "" && sum != snapshot.ArchiveSHA256 {
+			copyErr = fmt.Errorf("copy sha256 %s does not match %s", sum, snapshot.ArchiveSHA256)
+		}
+		finishCopy(backupID, c.Target, sum, n, copyErr)
+	}
+}
+
+func setCopyStatus(backupID, target, status string) {
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	if backup := findBackup(backupID); backup != nil {
+		if c := findCopy(backup, target); c != nil {
+			c.Status = status
+		}
+	}
+}
+
+// finishCopy records the outcome of one copy attempt.
+func finishCopy(backupID, target, sum string, size int64, err error) {
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	backup := findBackup(backupID)
+	if backup == nil {
+		return
+	}
+	c := findCopy(backup, target)
+	if c == nil {
+		return
+	}
+	c.Attempts++
+	c.SHA256 = sum
+	c.Size = size
+	if err != nil {
+		c.Status = CopyFailed
+		c.Error = err.Error()
+		c.VerifiedAt = nil
+		backup.Location = archiveLocation(backup)
+		emitEvent(EventReplicationFailed, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message:   fmt.Sprintf("Replication to %s failed (attempt %d): %s", target, c.Attempts, err),
+			DeviceID:  backup.DeviceID,
+			BackupID:  backupID,
+		}, map[string]interface{}{"target": target, "attempts": c.Attempts})
+		return
+	}
+	verifiedAt := time.Now()
+	c.Status = CopyVerified
+	c.Error = ""
+	c.VerifiedAt = &verifiedAt
+	backup.Location = archiveLocation(backup)
+	logs = append(logs, BackupLog{
+		Timestamp: verifiedAt,
+		Level:     "info",
+		Message:   fmt.Sprintf("Archive replicated to %s", target),
+		DeviceID:  backup.DeviceID,
+		BackupID:  backupID,
+	})
+}
+
+// removeReplicas deletes every server-side copy of a backup's archive other
+// than the primary.
+func removeReplicas(backup *Backup) {
+	for _, c := range backup.Copies {
+		if c.Target == deviceCopyTarget || c.Target == backup.Storage {
+			continue
+		}
+		store, ok := storageBackends[c.Target]
+		if !ok {
+			continue
+		}
+		if err := deleteArchiveFrom(backup, store); err != nil {
+			fmt.Printf("Failed to remove %s copy of backup %s: %s\n", c.Target, backup.ID, err)
+		}
+	}
+}
+
+// replicationRoutine applies replication policies to stored backups and
+// retries failed copies on a fixed interval.
+func replicationRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dataMu.Lock()
+		ids := []string{}
+		for i := range backups {
+			if planReplicas(&backups[i]) {
+				ids = append(ids, backups[i].ID)
+			}
+		}
+		dataMu.Unlock()
+
+		for _, id := range ids {
+			replicateBackup(id, false)
+		}
+	}
+}
+
+func replicationInterval() (time.Duration, error) {
+	if v := os.Getenv("REPLICATION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid REPLICATION_INTERVAL: %s", err)
+		}
+		return d, nil
+	}
+	return 15 * time.Minute, nil
+}
+
+// Rule321Result is a backup's standing against the 3-2-1 rule: at least
+// three verified copies, on two different kinds of media, one of them
+// offsite. Details lists the server-side copies; the device's own copy is
+// only as the agent reported it, so it is shown apart in DeviceCopy and
+// doesn't count.
+type Rule321Result struct {
+	BackupID   string        `json:"backupId"`
+	DeviceID   string        `json:"deviceId"`
+	DeviceName string        `json:"deviceName"`
+	Timestamp  time.Time     `json:"timestamp"`
+	Copies     int           `json:"copies"`
+	Media      []string      `json:"media"`
+	Offsite    int           `json:"offsite"`
+	Compliant  bool          `json:"compliant"`
+	Problems   []string      `json:"problems,omitempty"`
+	Details    []ArchiveCopy `json:"details"`
+	DeviceCopy string        `json:"deviceCopy,omitempty"`
+}
+
+// storageMedium classifies a copy's target for the "two media" part of the
+// rule.
+func storageMedium(target string) string {
+	switch storageBackends[target].(type) {
+	case *localStorage:
+		return "disk"
+	case *s3Storage:
+		return "object-storage"
+	case *memoryStorage:
+		return "memory"
+	}
+	return "unknown"
+}
+
+// check321 counts the device's reported copy and verified server copies.
+func check321(backup *Backup) Rule321Result {
+	result := Rule321Result{
+		BackupID:   backup.ID,
+		DeviceID:   backup.DeviceID,
+		DeviceName: backup.DeviceName,
+		Timestamp:  backup.Timestamp,
+		Media:      []string{},
+		Details:    []ArchiveCopy{},
+	}
+	media := map[string]bool{}
+	for _, c := range backupCopies(backup) {
+		if c.Target == deviceCopyTarget {
+			result.DeviceCopy = c.Status
+			continue
+		}
+		result.Details = append(result.Details, c)
+		if c.Status != CopyVerified {
+			result.Problems = append(result.Problems, fmt.Sprintf("copy on %s is %s", c.Target, c.Status))
+			continue
+		}
+		result.Copies++
+		media[storageMedium(c.Target)] = true
+		if offsiteTargets[c.Target] {
+			result.Offsite++
+		}
+	}
+	for medium := range media {
+		result.Media = append(result.Media, medium)
+	}
+	sort.Strings(result.Media)
+
+	if result.Copies < 3 {
+		result.Problems = append(result.Problems, fmt.Sprintf("only %d verified copies, need 3", result.Copies))
+	}
+	if len(result.Media) < 2 {
+		result.Problems = append(result.Problems, fmt.Sprintf("only %d kind(s) of media, need 2", len(result.Media)))
+	}
+	if result.Offsite < 1 {
+		result.Problems = append(result.Problems, "no offsite copy")
+	}
+	result.Compliant = result.Copies >= 3 && len(result.Media) >= 2 && result.Offsite >= 1
+	return result
+}
+
+// Replication handlers
+func getReplicationPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replicationPolicies)
+}
+
+func createReplicationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy ReplicationPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validReplicationPolicy(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy.ID = fmt.Sprintf("%d", nextReplicationID)
+	nextReplicationID++
+	replicationPolicies = append(replicationPolicies, policy)
+	setAuditResource(r, "replication-policy/"+policy.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(policy)
+}
+
+func updateReplicationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	existing := findReplicationPolicy(mux.Vars(r)["id"])
+	if existing == nil {
+		http.Error(w, "Replication policy not found", http.StatusNotFound)
+		return
+	}
+
+	var policy ReplicationPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validReplicationPolicy(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy.ID = existing.ID
+	*existing = policy
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func deleteReplicationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for i := range replicationPolicies {
+		if replicationPolicies[i].ID == id {
+			replicationPolicies = append(replicationPolicies[:i], replicationPolicies[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Replication policy not found", http.StatusNotFound)
+}
+
+// replicateBackupHandler copies a backup to its policy targets now, retrying
+// failed copies regardless of earlier attempts, and returns the result.
+func replicateBackupHandler(w http.ResponseWriter, r *http.Request) {
+	backupID := mux.Vars(r)["backupId"]
+
+	dataMu.Lock()
+	found := findBackup(backupID) != nil
+	dataMu.Unlock()
+	if !found {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+
+	replicateBackup(backupID, true)
+
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	backup := findBackup(backupID)
+	if backup == nil {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+// get321ReportHandler lists completed backups that fail the 3-2-1 rule, or
+// all of them with ?all=true. ?latest=true checks only each device's newest
+// completed backup.
+func get321ReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	all := q.Get("all") == "true"
+
+	candidates := []*Backup{}
+	if q.Get("latest") == "true" {
+		latest := map[string]*Backup{}
+		for i := range backups {
+			backup := &backups[i]
+			if backup.Status != "completed" {
+				continue
+			}
+			if current, ok := latest[backup.DeviceID]; !ok || backup.Timestamp.After(current.Timestamp) {
+				latest[backup.DeviceID] = backup
+			}
+		}
+		for _, backup := range latest {
+			candidates = append(candidates, backup)
+		}
+	} else {
+		for i := range backups {
+			if backups[i].Status == "completed" {
+				candidates = append(candidates, &backups[i])
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Timestamp.After(candidates[j].Timestamp) })
+
+	report := struct {
+		GeneratedAt time.Time       `json:"generatedAt"`
+		Checked     int             `json:"checked"`
+		Compliant   int             `json:"compliant"`
+		Failing     int             `json:"failing"`
+		Backups     []Rule321Result `json:"backups"`
+	}{GeneratedAt: time.Now(), Backups: []Rule321Result{}}
+	for _, backup := range candidates {
+		result := check321(backup)
+		report.Checked++
+		if result.Compliant {
+			report.Compliant++
+		} else {
+			report.Failing++
+		}
+		if all || !result.Compliant {
+			report.Backups = append(report.Backups, result)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RestoreLink is one archive of a point-in-time restore. Links are applied
+// in order: the full backup first, then each incremental after deleting the
+// paths it lists.
+type RestoreLink struct {
+	BackupID      string    `json:"backupId"`
+	Kind          string    `json:"kind"`
+	Timestamp     time.Time `json:"timestamp"`
+	Size          int64     `json:"size"`
+	ArchiveSHA256 string    `json:"archiveSha256,omitempty"`
+	EncryptionKey string    `json:"encryptionKey,omitempty"`
+	Deleted       []string  `json:"deleted,omitempty"`
+	// For an end-to-end encrypted link, its sealed manifest, which holds
+	// the deletions instead.
+	SealedManifest string `json:"sealedManifest,omitempty"`
+}
+
+// RestorePlan restores a device as of a point in time from the latest
+// completed backup taken at or before it. Problems lists the chain links
+// that are missing or damaged; a plan with problems must not be applied.
+type RestorePlan struct {
+	DeviceID string        `json:"deviceId"`
+	At       time.Time     `json:"at"`
+	BackupID string        `json:"backupId"`
+	Links    []RestoreLink `json:"links"`
+	Files    int           `json:"files"`
+	// The server can merge the chain into one archive unless a link is
+	// end-to-end encrypted.
+	Synthesizable bool     `json:"synthesizable"`
+	Verified      bool     `json:"verified"`
+	Problems      []string `json:"problems,omitempty"`
+}
+
+// planRestore resolves the chain that restores a device as of at. It returns
+// nil if the device has no completed backup by then. The caller must hold
+// dataMu.
+func planRestore(deviceID string, at time.Time) (*RestorePlan, []Backup) {
+	var target *Backup
+	for i := range backups {
+		b := &backups[i]
+		if b.DeviceID != deviceID || b.Status != "completed" || b.Timestamp.After(at) {
+			continue
+		}
+		// A synthetic full stands in for the chain it has the timestamp of.
+		if target == nil || b.Timestamp.After(target.Timestamp) ||
+			b.Timestamp.Equal(target.Timestamp) && b.ParentID == "" {
+			target = b
+		}
+	}
+	if target == nil {
+		return nil, nil
+	}
+
+	plan := &RestorePlan{DeviceID: deviceID, At: at, BackupID: target.ID, Links: []RestoreLink{}, Synthesizable: true}
+	chain, err := backupChain(target)
+	if err != nil {
+		plan.Problems = append(plan.Problems, err.Error())
+		return plan, nil
+	}
+	links := []Backup{}
+	for _, b := range chain {
+		link := RestoreLink{
+			BackupID:      b.ID,
+			Kind:          backupKind(b),
+			Timestamp:     b.Timestamp,
+			Size:          b.Size,
+			ArchiveSHA256: b.ArchiveSHA256,
+			EncryptionKey: b.EncryptionKey,
+		}
+		if manifest, ok := manifests[b.ID]; ok {
+			link.Deleted = manifest.Deleted
+			link.SealedManifest = manifest.Sealed
+		} else {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("backup %s has no manifest", b.ID))
+		}
+		if b.Status != "completed" {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("backup %s is %s", b.ID, b.Status))
+		}
+		if b.VerifyStatus == "failed" {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("backup %s failed its last verification", b.ID))
+		}
+		if b.EncryptionKey != "" {
+			plan.Synthesizable = false
+		}
+		plan.Links = append(plan.Links, link)
+		links = append(links, *b)
+	}
+	if merged, err := mergedManifest(target); err == nil {
+		plan.Files = len(merged.Entries)
+	}
+	return plan, links
+}
+
+// checkRestoreLinks makes sure every archive of a plan is stored and, with
+// verify, that it still hashes to what the agent uploaded. The caller must
+// not hold dataMu.
+func checkRestoreLinks(plan *RestorePlan, links []Backup, verify bool) {
+	for i := range links {
+		b := &links[i]
+		if !archiveExists(b) {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("archive of backup %s is not stored on the server", b.ID))
+			continue
+		}
+		if !verify || b.ArchiveSHA256 == "" {
+			continue
+		}
+		reader, err := openArchive(b)
+		if err != nil {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("archive of backup %s: %s", b.ID, err))
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, reader)
+		reader.Close()
+		if err != nil {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("archive of backup %s: %s", b.ID, err))
+		} else if sum := hex.EncodeToString(h.Sum(nil)); sum != b.ArchiveSHA256 {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("archive of backup %s is corrupt: sha256 %s, expected %s", b.ID, sum, b.ArchiveSHA256))
+		}
+	}
+	plan.Verified = verify && len(plan.Problems) == 0
+}
+
+// restoreRequest parses the device and ?at= of a point-in-time restore
+// request and builds its plan. It writes the error response itself and
+// returns nil when the request can't be served.
+func restoreRequest(w http.ResponseWriter, r *http.Request) (*RestorePlan, []Backup) {
+	deviceID := mux.Vars(r)["deviceId"]
+	at := time.Now()
+	if v := r.URL.Query().Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid at timestamp, expected RFC 3339", http.StatusBadRequest)
+			return nil, nil
+		}
+		at = t
+	}
+
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil
+	}
+	plan, links := planRestore(deviceID, at)
+	if plan == nil {
+		http.Error(w, fmt.Sprintf("Device has no completed backup as of %s", at.Format(time.RFC3339)), http.StatusNotFound)
+		return nil, nil
+	}
+	return plan, links
+}
+
+// writeSynthesizedArchive writes the chain's merged state as one tar.gz:
+// each path comes from the newest link that holds it, and paths deleted
+// later in the chain are left out.
+func writeSynthesizedArchive(w io.Writer, links []Backup, chainManifests []*Manifest) error {
+	owner := map[string]int{}
+	for i, manifest := range chainManifests {
+		if deleted := manifestDeletions(manifest); len(deleted) > 0 {
+			for p := range owner {
+				if deleted.covers(p) {
+					delete(owner, p)
+				}
+			}
+		}
+		for _, entry := range manifest.Entries {
+			owner[entry.Path] = i
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	written := map[string]bool{}
+	for i := range links {
+		err := walkArchive(&links[i], func(hdr *tar.Header, tr *tar.Reader) error {
+			if o, ok := owner[hdr.Name]; !ok || o != i || written[hdr.Name] {
+				return nil
+			}
+			// A hard link whose target isn't in the restore would dangle.
+			if hdr.Typeflag == tar.TypeLink && !written[hdr.Linkname] {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+			written[hdr.Name] = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("backup %s: %s", links[i].ID, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Point-in-time restore handlers
+func getRestorePlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, links := restoreRequest(w, r)
+	if plan == nil {
+		return
+	}
+	checkRestoreLinks(plan, links, r.URL.Query().Get("verify") == "true")
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(plan.Problems) > 0 {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(plan)
+}
+
+// downloadRestoreArchiveHandler streams the device's state as of ?at= as a
+// single archive. Every link is checked against its hash before anything is
+// sent, so a damaged chain fails up front instead of mid-restore.
+func downloadRestoreArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	plan, links := restoreRequest(w, r)
+	if plan == nil {
+		return
+	}
+	auditAccess(r, fmt.Sprintf("device/%s@%s", plan.DeviceID, plan.At.Format(time.RFC3339)))
+	if !plan.Synthesizable {
+		http.Error(w, "Backup chain is end-to-end encrypted; restore its links in order on the device", http.StatusConflict)
+		return
+	}
+	checkRestoreLinks(plan, links, true)
+	if len(plan.Problems) > 0 {
+		http.Error(w, "Backup chain is not restorable: "+strings.Join(plan.Problems, "; "), http.StatusConflict)
+		return
+	}
+
+	dataMu.Lock()
+	chainManifests := []*Manifest{}
+	for _, link := range links {
+		chainManifests = append(chainManifests, manifests[link.ID])
+	}
+	logs = append(logs, BackupLog{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   fmt.Sprintf("Point-in-time restore as of %s from %d backup(s)", plan.At.Format(time.RFC3339), len(links)),
+		DeviceID:  plan.DeviceID,
+		BackupID:  plan.BackupID,
+	})
+	dataMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.tar.gz"`, plan.DeviceID, plan.At.UTC().Format("20060102-150405")))
+	if err := writeSynthesizedArchive(w, links, chainManifests); err != nil {
+		// Headers are already sent; leaving the gzip stream without a
+		// trailer makes clients see a truncated archive.
+		fmt.Printf("Failed to send point-in-time restore of device %s: %s\n", plan.DeviceID, err)
+	}
+}
+
+// RestoreReport is what an agent sends once it has finished restoring a
+// backup (BackupID) or its state as of a point in time (At).
+type RestoreReport struct {
+	BackupID string     `json:"backupId,omitempty"`
+	At       *time.Time `json:"at,omitempty"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// reportRestoreHandler records a restore an agent has finished and raises
+// restore.finished for it, as restore tests do.
+func reportRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	if findDevice(deviceID) == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	var report RestoreReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Status != "completed" && report.Status != "failed" {
+		http.Error(w, `status must be "completed" or "failed"`, http.StatusBadRequest)
+		return
+	}
+	if report.BackupID != "" {
+		if backup := findBackup(report.BackupID); backup == nil || backup.DeviceID != deviceID {
+			http.Error(w, "Backup not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	what := "Restore of backup " + report.BackupID
+	data := map[string]interface{}{"kind": "restore", "status": report.Status}
+	if report.At != nil {
+		what = "Point-in-time restore as of " + report.At.Format(time.RFC3339)
+		data["at"] = report.At
+	}
+	level, message := "info", what+" completed on the device"
+	if report.Status == "failed" {
+		level, message = "error", what+" failed on the device"
+		if report.Error != "" {
+			message += ": " + report.Error
+		}
+	}
+	emitEvent(EventRestoreFinished, BackupLog{
+		Timestamp: time.Now(),
+		Level:     level,
+		Message:   message,
+		DeviceID:  deviceID,
+		BackupID:  report.BackupID,
+	}, data)
+	touchDevice(deviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RestoreAssertion is a user-defined check run against a sandbox restore.
+// Scripts run with sh -c inside the sandbox directory, so a check like
+// "etc/hostname exists" is simply `test -f etc/hostname`. Assertions are
+// loaded from the file named by RESTORE_TEST_ASSERTIONS, never from the
+// API, since they execute on the server.
+type RestoreAssertion struct {
+	Name       string `json:"name"`
+	DeviceID   string `json:"deviceId,omitempty"`
+	DeviceType string `json:"deviceType,omitempty"`
+	Script     string `json:"script"`
+}
+
+type AssertionResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Output string `json:"output,omitempty"`
+}
+
+// RestoreTest records one sandbox restore of a backup.
+type RestoreTest struct {
+	ID           string            `json:"id"`
+	BackupID     string            `json:"backupId"`
+	DeviceID     string            `json:"deviceId"`
+	StartedAt    time.Time         `json:"startedAt"`
+	FinishedAt   time.Time         `json:"finishedAt"`
+	Status       string            `json:"status"`
+	FilesChecked int               `json:"filesChecked"`
+	Errors       []string          `json:"errors,omitempty"`
+	Assertions   []AssertionResult `json:"assertions,omitempty"`
+}
+
+const (
+	assertionTimeout      = 30 * time.Second
+	assertionOutputLimit  = 4096
+	restoreTestHistoryMax = 1000
+)
+
+var (
+	restoreTests      []RestoreTest
+	restoreAssertions []RestoreAssertion
+	restoreTestSeq    int
+	// restoreTestRunning stops a manual run overlapping a scheduled one.
+	restoreTestRunning sync.Mutex
+)
+
+func loadRestoreAssertions(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read restore assertions: %s", err)
+	}
+	if err := json.Unmarshal(data, &restoreAssertions); err != nil {
+		return fmt.Errorf("failed to parse restore assertions: %s", err)
+	}
+	return nil
+}
+
+// sandboxPath turns an archive entry name into a clean relative path, or
+// "" if the entry would land outside the sandbox.
+func sandboxPath(name string) string {
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") {
+		return ""
+	}
+	return clean
+}
+
+func hashSandboxFile(root *os.Root, name string) (string, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extractToSandbox restores an archive into dir. All file operations go
+// through an os.Root, so symlinks inside the archive can't be used to write
+// outside the sandbox.
+func extractToSandbox(r io.Reader, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %s", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+		name := sandboxPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		if dir := path.Dir(name); dir != "." {
+			if err := root.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		perm := fs.FileMode(hdr.Mode) & fs.ModePerm
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0755); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			root.Chmod(name, perm|0700)
+		case tar.TypeReg:
+			f, err := root.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			root.Chmod(name, perm|0600)
+			root.Chtimes(name, hdr.ModTime, hdr.ModTime)
+		case tar.TypeSymlink:
+			if err := root.Symlink(hdr.Linkname, name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		case tar.TypeLink:
+			target := sandboxPath(hdr.Linkname)
+			if target == "" {
+				continue
+			}
+			if err := root.Link(target, name); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+}
+
+// checkSandbox compares the restored files on disk with the manifest.
+func checkSandbox(dir string, manifest *Manifest) (int, []string) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return 0, []string{err.Error()}
+	}
+	defer root.Close()
+
+	checked := 0
+	problems := []string{}
+	for _, entry := range manifest.Entries {
+		name := sandboxPath(entry.Path)
+		if name == "" || entry.Type == "other" {
+			continue
+		}
+		if len(problems) >= verifyErrorLimit {
+			break
+		}
+		checked++
+
+		info, err := root.Lstat(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: not restored", entry.Path))
+			continue
+		}
+		switch entry.Type {
+		case "dir":
+			if !info.IsDir() {
+				problems = append(problems, fmt.Sprintf("%s: restored as %s, not a directory", entry.Path, info.Mode().Type()))
+			}
+		case "symlink":
+			target, err := root.Readlink(name)
+			if err != nil || target != entry.LinkTarget {
+				problems = append(problems, fmt.Sprintf("%s: symlink target %q, manifest says %q", entry.Path, target, entry.LinkTarget))
+			}
+		case "file":
+			if !info.Mode().IsRegular() {
+				problems = append(problems, fmt.Sprintf("%s: not restored as a regular file", entry.Path))
+				continue
+			}
+			if info.Size() != entry.Size {
+				problems = append(problems, fmt.Sprintf("%s: restored size %d, manifest says %d", entry.Path, info.Size(), entry.Size))
+				continue
+			}
+			sum, err := hashSandboxFile(root, name)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", entry.Path, err))
+			} else if sum != entry.SHA256 {
+				problems = append(problems, fmt.Sprintf("%s: restored sha256 %s, manifest says %s", entry.Path, sum, entry.SHA256))
+			}
+		}
+	}
+	return checked, problems
+}
+
+func runAssertion(a RestoreAssertion, dir string, backup *Backup) AssertionResult {
+	ctx, cancel := context.WithTimeout(context.Background(), assertionTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", a.Script)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"SANDBOX_DIR="+dir,
+		"BACKUP_ID="+backup.ID,
+		"DEVICE_ID="+backup.DeviceID,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	output := out.String()
+	if len(output) > assertionOutputLimit {
+		output = output[:assertionOutputLimit] + "..."
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		output += fmt.Sprintf("\ntimed out after %s", assertionTimeout)
+	}
+	return AssertionResult{Name: a.Name, Passed: err == nil, Output: strings.TrimSpace(output)}
+}
+
+// runRestoreTest extracts backup into a fresh sandbox, checks it against the
+// manifest and runs the assertions that apply to the device.
+func runRestoreTest(backup Backup, deviceType string, manifest *Manifest, assertions []RestoreAssertion) (test RestoreTest) {
+	test = RestoreTest{BackupID: backup.ID, DeviceID: backup.DeviceID, StartedAt: time.Now()}
+	defer func() {
+		test.FinishedAt = time.Now()
+		test.Status = "passed"
+		if len(test.Errors) > 0 {
+			test.Status = "failed"
+		}
+		for _, a := range test.Assertions {
+			if !a.Passed {
+				test.Status = "failed"
+			}
+		}
+	}()
+
+	dir, err := os.MkdirTemp(os.Getenv("RESTORE_TEST_DIR"), "restore-test-"+backup.ID+"-")
+	if err != nil {
+		test.Errors = append(test.Errors, fmt.Sprintf("failed to create sandbox: %s", err))
+		return test
+	}
+	defer os.RemoveAll(dir)
+
+	reader, err := openArchive(&backup)
+	if err != nil {
+		test.Errors = append(test.Errors, fmt.Sprintf("failed to open archive: %s", err))
+		return test
+	}
+	err = extractToSandbox(reader, dir)
+	reader.Close()
+	if err != nil {
+		test.Errors = append(test.Errors, fmt.Sprintf("restore failed: %s", err))
+		return test
+	}
+
+	test.FilesChecked, test.Errors = checkSandbox(dir, manifest)
+
+	for _, a := range assertions {
+		if a.DeviceID != "" && a.DeviceID != backup.DeviceID {
+			continue
+		}
+		if a.DeviceType != "" && a.DeviceType != deviceType {
+			continue
+		}
+		test.Assertions = append(test.Assertions, runAssertion(a, dir, &backup))
+	}
+	return test
+}
+
+// restoreTestCandidates picks the most recent completed backups of each
+// device that the server can actually restore. Archives are only checked
+// for once dataMu is released, since on S3 every check is a request; the
+// caller must not hold dataMu.
+func restoreTestCandidates(perDevice int) []Backup {
+	dataMu.Lock()
+	byDevice := map[string][]Backup{}
+	for _, backup := range backups {
+		if backup.Status != "completed" || backup.EncryptionKey != "" {
+			continue
+		}
+		if _, ok := manifests[backup.ID]; !ok {
+			continue
+		}
+		byDevice[backup.DeviceID] = append(byDevice[backup.DeviceID], backup)
+	}
+	dataMu.Unlock()
+
+	candidates := []Backup{}
+	for _, list := range byDevice {
+		sort.Slice(list, func(i, j int) bool { return list[i].Timestamp.After(list[j].Timestamp) })
+		picked := 0
+		for i := 0; i < len(list) && picked < perDevice; i++ {
+			if archiveExists(&list[i]) {
+				candidates = append(candidates, list[i])
+				picked++
+			}
+		}
+	}
+	return candidates
+}
+
+// recordRestoreTest stores a result, logs it, and flags the device when its
+// latest backup failed. The caller must hold dataMu.
+func recordRestoreTest(test RestoreTest) {
+	restoreTestSeq++
+	test.ID = strconv.Itoa(restoreTestSeq)
+	restoreTests = append(restoreTests, test)
+	if len(restoreTests) > restoreTestHistoryMax {
+		restoreTests = restoreTests[len(restoreTests)-restoreTestHistoryMax:]
+	}
+
+	level, message := "info", "Restore test passed"
+	if test.Status != "passed" {
+		level, message = "error", "Restore test failed"
+		if len(test.Errors) > 0 {
+			message += ": " + test.Errors[0]
+		} else {
+			for _, a := range test.Assertions {
+				if !a.Passed {
+					message += fmt.Sprintf(": assertion %q failed", a.Name)
+					break
+				}
+			}
+		}
+	}
+	emitEvent(EventRestoreFinished, BackupLog{
+		Timestamp: test.FinishedAt,
+		Level:     level,
+		Message:   message,
+		DeviceID:  test.DeviceID,
+		BackupID:  test.BackupID,
+	}, map[string]interface{}{"kind": "restore-test", "restoreTestId": test.ID, "status": test.Status})
+
+	device := findDevice(test.DeviceID)
+	if device == nil {
+		return
+	}
+	testedAt := findBackupTimestamp(test.BackupID)
+	for _, backup := range backups {
+		if backup.DeviceID == test.DeviceID && backup.Status == "completed" && backup.Timestamp.After(testedAt) {
+			// A newer backup exists; its own test decides the device flag.
+			return
+		}
+	}
+	if test.Status == "passed" {
+		if device.RestoreTestStatus == "failed" && device.Status == "warning" {
+			device.Status = "online"
+		}
+	} else if device.Status == "online" {
+		device.Status = "warning"
+	}
+	device.RestoreTestStatus = test.Status
+}
+
+func findBackupTimestamp(id string) time.Time {
+	if backup := findBackup(id); backup != nil {
+		return backup.Timestamp
+	}
+	return time.Time{}
+}
+
+// runRestoreTests tests the latest backups of every device.
+func runRestoreTests(perDevice int) {
+	if !restoreTestRunning.TryLock() {
+		return
+	}
+	defer restoreTestRunning.Unlock()
+
+	type job struct {
+		backup     Backup
+		deviceType string
+		manifest   *Manifest
+	}
+	candidates := restoreTestCandidates(perDevice)
+	dataMu.Lock()
+	jobs := []job{}
+	for _, backup := range candidates {
+		manifest, ok := manifests[backup.ID]
+		if !ok {
+			// Pruned since it was picked.
+			continue
+		}
+		j := job{backup: backup, manifest: manifest}
+		if device := findDevice(backup.DeviceID); device != nil {
+			j.deviceType = device.Type
+		}
+		jobs = append(jobs, j)
+	}
+	assertions := restoreAssertions
+	dataMu.Unlock()
+
+	for _, j := range jobs {
+		test := runRestoreTest(j.backup, j.deviceType, j.manifest, assertions)
+		dataMu.Lock()
+		recordRestoreTest(test)
+		dataMu.Unlock()
+	}
+}
+
+// restoreTestRoutine runs restore tests on a fixed interval.
+func restoreTestRoutine(interval time.Duration, perDevice int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		runRestoreTests(perDevice)
+	}
+}
+
+func restoreTestSettings() (time.Duration, int, error) {
+	interval := 24 * time.Hour
+	if v := os.Getenv("RESTORE_TEST_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid RESTORE_TEST_INTERVAL: %s", err)
+		}
+		interval = d
+	}
+	perDevice := 1
+	if v := os.Getenv("RESTORE_TEST_PER_DEVICE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("invalid RESTORE_TEST_PER_DEVICE")
+		}
+		perDevice = n
+	}
+	return interval, perDevice, nil
+}
+
+// Restore test handlers
+func getRestoreTestsHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("deviceId")
+	if v := mux.Vars(r)["deviceId"]; v != "" {
+		deviceID = v
+	}
+
+	tests := []RestoreTest{}
+	for _, test := range restoreTests {
+		if deviceID == "" || test.DeviceID == deviceID {
+			tests = append(tests, test)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tests)
+}
+
+func getRestoreTestHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, test := range restoreTests {
+		if test.ID == id {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(test)
+			return
+		}
+	}
+	http.Error(w, "Restore test not found", http.StatusNotFound)
+}
+
+func runRestoreTestsHandler(w http.ResponseWriter, r *http.Request) {
+	_, perDevice, err := restoreTestSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go runRestoreTests(perDevice)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// pruneBackups drops backups older than their device schedule's retention
+// period (in days) from the catalog and returns them; their stored archives
+// are left for removePrunedArchives. Pinned backups, the latest completed
+// backup of each device and every backup a kept incremental depends on are
+// always kept. The caller must hold dataMu.
+func pruneBackups(now time.Time) []Backup {
+	latest := map[string]time.Time{}
+	for _, backup := range backups {
+		if backup.Status == "completed" && backup.Timestamp.After(latest[backup.DeviceID]) {
+			latest[backup.DeviceID] = backup.Timestamp
+		}
+	}
+
+	keep := map[string]bool{}
+	for _, backup := range backups {
+		schedule := findSchedule(backup.DeviceID)
+		expired := schedule != nil && schedule.Retention > 0 &&
+			backup.Timestamp.Before(now.AddDate(0, 0, -schedule.Retention))
+		if !expired || backup.Pinned || backup.Status == "in-progress" || !backup.Timestamp.Before(latest[backup.DeviceID]) {
+			keep[backup.ID] = true
+		}
+	}
+	// Pruning a link would break every incremental taken on top of it.
+	for id := range keep {
+		for parent := findBackup(id); parent != nil && parent.ParentID != "" && !keep[parent.ParentID]; {
+			keep[parent.ParentID] = true
+			parent = findBackup(parent.ParentID)
+		}
+	}
+
+	kept := backups[:0]
+	pruned := []Backup{}
+	for _, backup := range backups {
+		if keep[backup.ID] {
+			kept = append(kept, backup)
+			continue
+		}
+		pruned = append(pruned, backup)
+	}
+	backups = kept
+
+	for _, backup := range pruned {
+		releaseStorageUsed(&backup)
+		delete(manifests, backup.ID)
+		delete(fileIndexes, backup.ID)
+		delete(driftReports, backup.ID)
+		logs = append(logs, BackupLog{
+			Timestamp: now,
+			Level:     "info",
+			Message:   fmt.Sprintf("Backup pruned by retention policy (taken %s)", backup.Timestamp.Format(time.RFC3339)),
+			DeviceID:  backup.DeviceID,
+			BackupID:  backup.ID,
+		})
+	}
+	return pruned
+}
+
+// removePrunedArchives deletes every stored copy of the pruned backups. It
+// goes out to the storage backends, so the caller must not hold dataMu.
+func removePrunedArchives(pruned []Backup) {
+	for i := range pruned {
+		backup := &pruned[i]
+		if err := removeArchive(backup); err != nil {
+			fmt.Printf("Failed to remove archive of pruned backup %s: %s\n", backup.ID, err)
+		}
+		removeReplicas(backup)
+		unstageArchive(backup.ID)
+		forgetChunkIndex(backup.ID)
+	}
+}
+
+// retentionRoutine prunes expired backups on a fixed interval.
+func retentionRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		dataMu.Lock()
+		pruned := pruneBackups(time.Now())
+		dataMu.Unlock()
+		removePrunedArchives(pruned)
+	}
+}
+
+// retentionInterval reads RETENTION_INTERVAL. Pruning deletes backups, so it
+// only runs when an interval is set.
+func retentionInterval() (time.Duration, error) {
+	v := os.Getenv("RETENTION_INTERVAL")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RETENTION_INTERVAL: %s", err)
+	}
+	return d, nil
+}
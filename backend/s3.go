@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage stores archives in an S3-compatible bucket (AWS S3, MinIO, ...),
+// signing requests with AWS Signature Version 4.
+type s3Storage struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// Path-style addressing (endpoint/bucket/key) rather than
+	// virtual-hosted (bucket.endpoint/key); MinIO needs it.
+	pathStyle bool
+	client    *http.Client
+}
+
+// Single PUT requests are limited to 5 GiB by S3.
+const s3MaxPutSize = 5 << 30
+
+// newS3StorageFromEnv configures the driver from S3_BUCKET, S3_REGION,
+// S3_ENDPOINT, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY, S3_SESSION_TOKEN,
+// S3_PREFIX and S3_PATH_STYLE.
+func newS3StorageFromEnv() (*s3Storage, error) {
+	s := &s3Storage{
+		region:       os.Getenv("S3_REGION"),
+		bucket:       os.Getenv("S3_BUCKET"),
+		prefix:       strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		accessKey:    os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("S3_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("S3_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 30 * time.Minute},
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	} else {
+		// Custom endpoints are usually MinIO or similar.
+		s.pathStyle = true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	s.endpoint = u
+	if v := os.Getenv("S3_PATH_STYLE"); v != "" {
+		if s.pathStyle, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid S3_PATH_STYLE %q", v)
+		}
+	}
+	return s, nil
+}
+
+func (s *s3Storage) Name() string { return "s3" }
+
+func (s *s3Storage) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// SigV4 canonicalization requires; slashes are kept when encoding paths.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// requestURL builds the URL for an object key (empty for the bucket itself)
+// with its path and query already in canonical form.
+func (s *s3Storage) requestURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		p += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" {
+		p += "/" + key
+	}
+	if p == "" {
+		p = "/"
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, true)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	u.RawQuery = strings.Join(parts, "&")
+	return &u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds SigV4 headers to req. Payloads are not hashed
+// (UNSIGNED-PAYLOAD), so archives can be streamed.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request and turns S3 error responses into errors.
+func (s *s3Storage) do(method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the canonical encoding; NewRequest re-parses the URL.
+	req.URL = u
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, &e)
+	// HEAD responses carry no body, so a bare 404 means the key is missing.
+	if resp.StatusCode == http.StatusNotFound && (e.Code == "" || e.Code == "NoSuchKey") {
+		return nil, ErrObjectNotFound
+	}
+	if e.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", method, u.Path, resp.Status)
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("s3 uploads need a known size")
+	}
+	if size > s3MaxPutSize {
+		return fmt.Errorf("archive of %d bytes exceeds the 5 GiB single upload limit", size)
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := s.do("PUT", s.requestURL(s.objectKey(key), nil), io.NopCloser(r), size, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length >= 0 {
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do("GET", s.requestURL(s.objectKey(key), nil), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Get("Range") != "" && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 GET %s: range request not honored", key)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.requestURL(s.objectKey(key), nil), nil, 0, nil)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Stat(key string) (ObjectInfo, error) {
+	resp, err := s.do("HEAD", s.requestURL(s.objectKey(key), nil), nil, 0, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	fullPrefix := s.objectKey(prefix)
+	if s.prefix != "" && prefix == "" {
+		fullPrefix = s.prefix + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {fullPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", s.requestURL("", query), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: %s", err)
+		}
+		for _, c := range result.Contents {
+			key := c.Key
+			if s.prefix != "" {
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			objects = append(objects, ObjectInfo{Key: key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
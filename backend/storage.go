@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is where encrypted archives land. Keys are slash-separated
+// relative paths ("<deviceId>/<backupId>.enc"). Archives are encrypted before
+// they reach a driver, so drivers only ever see ciphertext.
+type Storage interface {
+	// Name identifies the backend; it is recorded on each Backup.
+	Name() string
+	// Put stores size bytes read from r under key, replacing any object
+	// already there.
+	Put(key string, r io.Reader, size int64) error
+	// Get returns length bytes of the object starting at offset; a negative
+	// length reads to the end.
+	Get(key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(key string) error
+	Stat(key string) (ObjectInfo, error)
+	// List returns the objects whose keys start with prefix, sorted by key.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// filePutter is implemented by drivers that can take ownership of a local
+// file more cheaply than copying it (the local driver renames it).
+type filePutter interface {
+	PutFile(key, name string) error
+}
+
+// volatileStorage is implemented by drivers whose objects are gone when the
+// server restarts.
+type volatileStorage interface {
+	Volatile() bool
+}
+
+func isVolatile(store Storage) bool {
+	v, ok := store.(volatileStorage)
+	return ok && v.Volatile()
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// ErrObjectNotFound is returned by Get and Stat for missing keys.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Configured storage backends by name, and the one new archives go to
+var (
+	storageBackends = map[string]Storage{}
+	activeStorage   Storage
+)
+
+// initStorage registers the local driver (always available, so archives
+// stored before a backend change stay readable) and the backend selected by
+// STORAGE_BACKEND, which new archives go to. STORAGE_DEDUP=false stores
+// archives whole instead of as deduplicated chunks.
+func initStorage() error {
+	local, err := newLocalStorage("local", getArchiveDir())
+	if err != nil {
+		return err
+	}
+	storageBackends[local.Name()] = local
+	activeStorage = local
+	if err := loadChunkState(filepath.Join(getArchiveDir(), "chunks.json")); err != nil {
+		return err
+	}
+
+	if v := os.Getenv("STORAGE_DEDUP"); v != "" {
+		if dedupEnabled, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid STORAGE_DEDUP %q", v)
+		}
+	}
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		store, err := registerStorage(backend)
+		if err != nil {
+			return err
+		}
+		activeStorage = store
+	}
+	return nil
+}
+
+// registerStorage configures the backend described by spec, unless one of
+// that name already exists: "local", "s3" (configured from S3_*), "memory",
+// or "<name>=<dir>" for another directory such as a NAS mount.
+func registerStorage(spec string) (Storage, error) {
+	name, dir, isDir := strings.Cut(spec, "=")
+	if store, ok := storageBackends[name]; ok {
+		if isDir {
+			return nil, fmt.Errorf("storage backend name %q is already in use", name)
+		}
+		return store, nil
+	}
+
+	var store Storage
+	var err error
+	switch {
+	case isDir:
+		if !validBackupID(name) || dir == "" {
+			return nil, fmt.Errorf("invalid storage backend %q", spec)
+		}
+		store, err = newLocalStorage(name, dir)
+	case name == "s3":
+		store, err = newS3StorageFromEnv()
+	case name == "memory":
+		store = newMemoryStorage()
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	storageBackends[store.Name()] = store
+	return store, nil
+}
+
+// storageFor returns the backend holding a backup's archive. Backups
+// recorded before storage backends existed live on the local driver.
+func storageFor(backup *Backup) (Storage, error) {
+	name := backup.Storage
+	if name == "" {
+		name = "local"
+	}
+	store, ok := storageBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("archive is on storage backend %q, which is not configured", name)
+	}
+	return store, nil
+}
+
+// Local directory driver
+
+type localStorage struct {
+	name string
+	dir  string
+	root *os.Root
+}
+
+func newLocalStorage(name, dir string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %s", err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage directory: %s", err)
+	}
+	return &localStorage{name: name, dir: dir, root: root}, nil
+}
+
+func (l *localStorage) Name() string { return l.name }
+
+func localKey(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return name, nil
+}
+
+func (l *localStorage) Put(key string, r io.Reader, size int64) error {
+	name, err := localKey(key)
+	if err != nil {
+		return err
+	}
+	if err := l.root.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", name, time.Now().UnixNano())
+	f, err := l.root.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer l.root.Remove(tmp)
+
+	n, err := io.Copy(f, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return l.root.Rename(tmp, name)
+}
+
+func (l *localStorage) PutFile(key, src string) error {
+	name, err := localKey(key)
+	if err != nil {
+		return err
+	}
+	if err := l.root.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return os.Rename(src, filepath.Join(l.dir, name))
+}
+
+func (l *localStorage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	name, err := localKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.root.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (l *localStorage) Delete(key string) error {
+	name, err := localKey(key)
+	if err != nil {
+		return err
+	}
+	if err := l.root.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *localStorage) Stat(key string) (ObjectInfo, error) {
+	name, err := localKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := l.root.Stat(name)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *localStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := fs.WalkDir(l.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(p, prefix) || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: p, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+// In-memory driver, for development and tests
+
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: map[string]memoryObject{}}
+}
+
+func (m *memoryStorage) Name() string { return "memory" }
+
+func (m *memoryStorage) Volatile() bool { return true }
+
+func (m *memoryStorage) Put(key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes, expected %d", len(data), size)
+	}
+	m.mu.Lock()
+	m.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	obj, ok := m.objects[key]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	if offset > int64(len(obj.data)) {
+		offset = int64(len(obj.data))
+	}
+	data := obj.data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStorage) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.objects, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStorage) Stat(key string) (ObjectInfo, error) {
+	m.mu.Lock()
+	obj, ok := m.objects[key]
+	m.mu.Unlock()
+	if !ok {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (m *memoryStorage) List(prefix string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	objects := []ObjectInfo{}
+	for key, obj := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// objectReaderAt adapts a stored object to io.ReaderAt for the decrypting
+// reader, fetching a window ahead of each read so sequential segment reads
+// don't turn into one request each. It is not safe for concurrent use.
+type objectReaderAt struct {
+	store  Storage
+	key    string
+	size   int64
+	buf    []byte
+	bufOff int64
+}
+
+const objectReadAhead = 1 << 20
+
+func (o *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > o.size {
+		end = o.size
+	}
+	if off < o.bufOff || end > o.bufOff+int64(len(o.buf)) {
+		n := int64(len(p))
+		if n < objectReadAhead {
+			n = objectReadAhead
+		}
+		if off+n > o.size {
+			n = o.size - off
+		}
+		rc, err := o.store.Get(o.key, off, n)
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(rc, buf)
+		rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %s", o.key, err)
+		}
+		o.buf, o.bufOff = buf, off
+	}
+	n := copy(p, o.buf[off-o.bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Storage handlers
+func getStorageHandler(w http.ResponseWriter, r *http.Request) {
+	type backendInfo struct {
+		Name       string `json:"name"`
+		Active     bool   `json:"active"`
+		Objects    int    `json:"objects"`
+		Bytes      int64  `json:"bytes"`
+		Chunks     int    `json:"chunks"`
+		ChunkBytes int64  `json:"chunkBytes"`
+		Error      string `json:"error,omitempty"`
+	}
+
+	names := []string{}
+	for name := range storageBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []backendInfo{}
+	for _, name := range names {
+		store := storageBackends[name]
+		info := backendInfo{Name: name, Active: store == activeStorage}
+		objects, err := store.List("")
+		if err != nil {
+			info.Error = err.Error()
+		}
+		for _, obj := range objects {
+			switch path.Ext(obj.Key) {
+			case ".enc":
+				info.Objects++
+				info.Bytes += obj.Size
+			case ".chunk":
+				info.Chunks++
+				info.ChunkBytes += obj.Size
+			}
+		}
+		result = append(result, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Synthetic full backups consolidate a device's incremental chain on the
+// server: the chain ending at the device's latest backup is merged into one
+// new full backup with the same timestamp, checked against the merged
+// manifest, and the incrementals built on the old tip are re-parented onto
+// it. Nothing depends on the old links afterwards, so retention can prune
+// them as they expire.
+
+// SyntheticFull is the outcome of consolidating one chain.
+type SyntheticFull struct {
+	DeviceID   string   `json:"deviceId"`
+	From       string   `json:"from"`
+	BackupID   string   `json:"backupId,omitempty"`
+	Links      int      `json:"links"`
+	Files      int      `json:"files,omitempty"`
+	Reparented []string `json:"reparented,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// A device's chain is consolidated by the scheduled job once it holds this
+// many incrementals.
+var syntheticMinIncrementals = 7
+
+var syntheticRunning bool
+
+// syntheticCandidate returns the chain ending at a device's latest
+// completed backup if it should be consolidated: it must end in an
+// incremental, not be consolidated yet, have at least minIncrementals
+// incrementals and not be end-to-end encrypted. The caller must hold dataMu.
+func syntheticCandidate(deviceID string, minIncrementals int) ([]Backup, []*Manifest) {
+	var tip *Backup
+	for i := range backups {
+		b := &backups[i]
+		if b.DeviceID == deviceID && b.Status == "completed" && (tip == nil || b.Timestamp.After(tip.Timestamp)) {
+			tip = b
+		}
+	}
+	if tip == nil || tip.ParentID == "" || tip.ConsolidatedInto != "" {
+		return nil, nil
+	}
+	chain, err := backupChain(tip)
+	if err != nil || len(chain)-1 < minIncrementals {
+		return nil, nil
+	}
+	links := []Backup{}
+	chainManifests := []*Manifest{}
+	for _, b := range chain {
+		manifest, ok := manifests[b.ID]
+		if b.EncryptionKey != "" || !ok {
+			return nil, nil
+		}
+		links = append(links, *b)
+		chainManifests = append(chainManifests, manifest)
+	}
+	return links, chainManifests
+}
+
+// runSyntheticFulls consolidates the chains of every device, or of one
+// device if deviceID is set. Archive I/O runs without dataMu; the caller
+// must not hold it. It returns nil if a run is already in progress.
+func runSyntheticFulls(deviceID string, minIncrementals int) []SyntheticFull {
+	type candidate struct {
+		links     []Backup
+		manifests []*Manifest
+	}
+	dataMu.Lock()
+	if syntheticRunning {
+		dataMu.Unlock()
+		return nil
+	}
+	syntheticRunning = true
+	candidates := []candidate{}
+	for _, device := range devices {
+		if deviceID != "" && device.ID != deviceID {
+			continue
+		}
+		if links, chainManifests := syntheticCandidate(device.ID, minIncrementals); links != nil {
+			candidates = append(candidates, candidate{links, chainManifests})
+		}
+	}
+	dataMu.Unlock()
+
+	defer func() {
+		dataMu.Lock()
+		syntheticRunning = false
+		dataMu.Unlock()
+	}()
+
+	results := []SyntheticFull{}
+	for _, c := range candidates {
+		results = append(results, synthesizeFull(c.links, c.manifests))
+	}
+	return results
+}
+
+// synthesizeFull merges a chain into a new full backup.
+func synthesizeFull(links []Backup, chainManifests []*Manifest) SyntheticFull {
+	tip := links[len(links)-1]
+	result := SyntheticFull{DeviceID: tip.DeviceID, From: tip.ID, Links: len(links)}
+	fail := func(err error) SyntheticFull {
+		result.BackupID = ""
+		result.Error = err.Error()
+		dataMu.Lock()
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message:   fmt.Sprintf("Failed to create synthetic full backup: %s", err),
+			DeviceID:  tip.DeviceID,
+			BackupID:  tip.ID,
+		})
+		dataMu.Unlock()
+		return result
+	}
+
+	plan := &RestorePlan{}
+	checkRestoreLinks(plan, links, true)
+	if len(plan.Problems) > 0 {
+		return fail(fmt.Errorf("chain is damaged: %s", plan.Problems[0]))
+	}
+	merged := chainManifests[0]
+	for _, manifest := range chainManifests[1:] {
+		merged = mergeManifest(merged, manifest)
+	}
+
+	synthetic := Backup{
+		ID:              fmt.Sprintf("synthetic-%s-%s", tip.DeviceID, tip.Timestamp.UTC().Format("20060102-150405")),
+		DeviceID:        tip.DeviceID,
+		DeviceName:      tip.DeviceName,
+		Timestamp:       tip.Timestamp,
+		Status:          "completed",
+		Type:            "synthetic",
+		Version:         tip.Version,
+		Kind:            BackupFull,
+		SynthesizedFrom: tip.ID,
+	}
+	result.BackupID = synthetic.ID
+	if !validBackupID(synthetic.ID) {
+		return fail(fmt.Errorf("invalid backup id %s", synthetic.ID))
+	}
+	dataMu.Lock()
+	exists := findBackup(synthetic.ID) != nil
+	dataMu.Unlock()
+	if exists {
+		return fail(fmt.Errorf("backup %s already exists", synthetic.ID))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeSynthesizedArchive(pw, links, chainManifests))
+	}()
+	h := sha256.New()
+	n, err := storeArchive(&synthetic, io.TeeReader(pr, h))
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return fail(err)
+	}
+	synthetic.Size = n
+	synthetic.ArchiveSHA256 = hex.EncodeToString(h.Sum(nil))
+
+	// The result must hold exactly what the merged manifest says.
+	manifest := &Manifest{ArchiveSHA256: synthetic.ArchiveSHA256, Entries: merged.Entries}
+	if check := verifyArchive(&synthetic, manifest); check.Status != "passed" {
+		discardSynthetic(&synthetic)
+		return fail(fmt.Errorf("result does not match the merged manifest: %s", check.Errors[0]))
+	}
+	verifiedAt := time.Now()
+	synthetic.VerifyStatus = "passed"
+	synthetic.VerifiedAt = &verifiedAt
+	synthetic.Files = len(manifest.Entries)
+	synthetic.Tier = TierHot
+	synthetic.Copies = []ArchiveCopy{{
+		Target:     synthetic.Storage,
+		Status:     CopyVerified,
+		SHA256:     synthetic.ArchiveSHA256,
+		Size:       n,
+		Attempts:   1,
+		VerifiedAt: &verifiedAt,
+	}}
+	synthetic.Location = archiveLocation(&synthetic)
+	result.Files = synthetic.Files
+
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	stored := findBackup(tip.ID)
+	if stored == nil || stored.ConsolidatedInto != "" || findBackup(synthetic.ID) != nil {
+		// Pruned or consolidated meanwhile.
+		discardSynthetic(&synthetic)
+		result.BackupID = ""
+		result.Error = "backup changed while consolidating"
+		return result
+	}
+	stored.ConsolidatedInto = synthetic.ID
+	for i := range backups {
+		if backups[i].ParentID == tip.ID {
+			backups[i].ParentID = synthetic.ID
+			result.Reparented = append(result.Reparented, backups[i].ID)
+		}
+	}
+	backups = append(backups, synthetic)
+	setManifest(synthetic.ID, manifest)
+	serverStatus.StorageUsed += n
+	logs = append(logs, BackupLog{
+		Timestamp: verifiedAt,
+		Level:     "info",
+		Message:   fmt.Sprintf("Synthetic full backup created from %d backup(s) ending at %s", len(links), tip.ID),
+		DeviceID:  tip.DeviceID,
+		BackupID:  synthetic.ID,
+	})
+	if planReplicas(&backups[len(backups)-1]) {
+		go replicateBackup(synthetic.ID, false)
+	}
+	return result
+}
+
+// discardSynthetic deletes the archive of a synthetic backup that never
+// made it into the catalog.
+func discardSynthetic(backup *Backup) {
+	if err := removeArchive(backup); err != nil {
+		fmt.Printf("Failed to remove synthetic backup %s: %s\n", backup.ID, err)
+	}
+	forgetChunkIndex(backup.ID)
+}
+
+// syntheticRoutine consolidates long chains on a fixed interval.
+func syntheticRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		runSyntheticFulls("", syntheticMinIncrementals)
+	}
+}
+
+// syntheticSettings reads SYNTHETIC_FULL_INTERVAL (default 24h) and
+// SYNTHETIC_FULL_MIN_CHAIN (default 7).
+func syntheticSettings() (time.Duration, error) {
+	if v := os.Getenv("SYNTHETIC_FULL_MIN_CHAIN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid SYNTHETIC_FULL_MIN_CHAIN %q", v)
+		}
+		syntheticMinIncrementals = n
+	}
+	if v := os.Getenv("SYNTHETIC_FULL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid SYNTHETIC_FULL_INTERVAL: %s", err)
+		}
+		return d, nil
+	}
+	return 24 * time.Hour, nil
+}
+
+// Synthetic full handlers
+func runSyntheticFullsHandler(w http.ResponseWriter, r *http.Request) {
+	results := runSyntheticFulls("", syntheticMinIncrementals)
+	if results == nil {
+		http.Error(w, "Consolidation is already running", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// createSyntheticFullHandler consolidates one device's chain now, however
+// short it is.
+func createSyntheticFullHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["deviceId"]
+	dataMu.Lock()
+	found := findDevice(deviceID) != nil
+	dataMu.Unlock()
+	if !found {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	results := runSyntheticFulls(deviceID, 1)
+	if results == nil {
+		http.Error(w, "Consolidation is already running", http.StatusConflict)
+		return
+	}
+	if len(results) == 0 {
+		http.Error(w, "Device has no incremental chain to consolidate", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if results[0].Error != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(results[0])
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Storage tiers
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// TieringRule moves the archives of completed backups older than AfterDays
+// to Target, the cold storage backend. Scope works as for replication
+// policies. When several rules apply, the one with the largest AfterDays
+// wins, so archives can step down through progressively colder targets.
+type TieringRule struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	AfterDays int    `json:"afterDays"`
+	Target    string `json:"target"`
+	DeviceID  string `json:"deviceId,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// TieringMove is the outcome of moving one archive.
+type TieringMove struct {
+	BackupID string `json:"backupId"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	tieringRules   = []TieringRule{}
+	nextTieringID  = 1
+	tieringRunning bool
+)
+
+// initTiering creates a default rule from TIERING_TARGET (same syntax as
+// STORAGE_BACKEND) and TIERING_AFTER_DAYS (default 30).
+func initTiering() error {
+	spec := os.Getenv("TIERING_TARGET")
+	if spec == "" {
+		return nil
+	}
+	store, err := registerStorage(spec)
+	if err != nil {
+		return err
+	}
+	afterDays := 30
+	if v := os.Getenv("TIERING_AFTER_DAYS"); v != "" {
+		if afterDays, err = strconv.Atoi(v); err != nil || afterDays <= 0 {
+			return fmt.Errorf("invalid TIERING_AFTER_DAYS %q", v)
+		}
+	}
+	tieringRules = append(tieringRules, TieringRule{
+		ID:        fmt.Sprintf("%d", nextTieringID),
+		Name:      "Default",
+		AfterDays: afterDays,
+		Target:    store.Name(),
+		Enabled:   true,
+	})
+	nextTieringID++
+	return nil
+}
+
+func validTieringRule(rule *TieringRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if rule.AfterDays <= 0 {
+		return fmt.Errorf("afterDays must be positive")
+	}
+	if _, ok := storageBackends[rule.Target]; !ok {
+		return fmt.Errorf("storage target %q is not configured", rule.Target)
+	}
+	if rule.DeviceID != "" && findDevice(rule.DeviceID) == nil {
+		return fmt.Errorf("device %s not found", rule.DeviceID)
+	}
+	if rule.GroupID != "" && findGroup(rule.GroupID) == nil {
+		return fmt.Errorf("group %s not found", rule.GroupID)
+	}
+	return nil
+}
+
+func findTieringRule(id string) *TieringRule {
+	for i := range tieringRules {
+		if tieringRules[i].ID == id {
+			return &tieringRules[i]
+		}
+	}
+	return nil
+}
+
+// tieringTarget returns the backend a backup's archive should be on, or ""
+// when no rule applies yet.
+func tieringTarget(backup *Backup, now time.Time) string {
+	target, days := "", 0
+	for _, rule := range tieringRules {
+		if !rule.Enabled || rule.AfterDays <= days || !scopeCovers(rule.DeviceID, rule.GroupID, backup.DeviceID) {
+			continue
+		}
+		if backup.Timestamp.Before(now.AddDate(0, 0, -rule.AfterDays)) {
+			target, days = rule.Target, rule.AfterDays
+		}
+	}
+	return target
+}
+
+// runTiering moves every archive that a rule says belongs on a colder
+// target. Each new copy is read back and checked against the archive hash
+// before the catalog switches over and the hot copy is deleted. Archive I/O
+// runs without dataMu; the caller must not hold it.
+func runTiering(now time.Time) []TieringMove {
+	dataMu.Lock()
+	if tieringRunning {
+		dataMu.Unlock()
+		return nil
+	}
+	tieringRunning = true
+	candidates := []Backup{}
+	for _, backup := range backups {
+		if backup.Status != "completed" || backup.Storage == "" || replicationInProgress[backup.ID] {
+			continue
+		}
+		if target := tieringTarget(&backup, now); target != "" && target != backup.Storage {
+			backup.Copies = append([]ArchiveCopy(nil), backup.Copies...)
+			candidates = append(candidates, backup)
+		}
+	}
+	dataMu.Unlock()
+
+	defer func() {
+		dataMu.Lock()
+		tieringRunning = false
+		dataMu.Unlock()
+	}()
+
+	moves := []TieringMove{}
+	for _, backup := range candidates {
+		moves = append(moves, moveToTier(backup, tieringTarget(&backup, now)))
+	}
+	return moves
+}
+
+func moveToTier(backup Backup, target string) TieringMove {
+	move := TieringMove{BackupID: backup.ID, From: backup.Storage, To: target}
+	fail := func(err error) TieringMove {
+		move.Error = err.Error()
+		dataMu.Lock()
+		logs = append(logs, BackupLog{
+			Timestamp: time.Now(),
+			Level:     "warning",
+			Message:   fmt.Sprintf("Failed to move archive to %s: %s", target, err),
+			DeviceID:  backup.DeviceID,
+			BackupID:  backup.ID,
+		})
+		dataMu.Unlock()
+		return move
+	}
+
+	from, err := storageFor(&backup)
+	if err != nil {
+		return fail(err)
+	}
+	to := storageBackends[target]
+
+	// An archive already replicated to the target needs no second copy,
+	// but it is read back again: the hot copy is about to go.
+	var sum string
+	var n int64
+	if c := findCopy(&backup, target); c != nil && c.Status == CopyVerified {
+		if sum, n, err = hashArchiveOn(&backup, to); err != nil {
+			return fail(err)
+		}
+		if sum != c.SHA256 || backup.ArchiveSHA256 != "" && sum != backup.ArchiveSHA256 {
+			return fail(fmt.Errorf("%s copy sha256 %s no longer matches", target, sum))
+		}
+	} else {
+		if sum, n, err = copyArchive(&backup, from, to); err != nil {
+			return fail(err)
+		}
+		if backup.ArchiveSHA256 != "" && sum != backup.ArchiveSHA256 {
+			deleteArchiveFrom(&backup, to)
+			return fail(fmt.Errorf("copy sha256 %s does not match %s", sum, backup.ArchiveSHA256))
+		}
+	}
+
+	dataMu.Lock()
+	stored := findBackup(backup.ID)
+	if stored == nil || stored.Storage != backup.Storage || stored.Chunked != backup.Chunked ||
+		stored.ArchiveSHA256 != backup.ArchiveSHA256 {
+		// Pruned or re-uploaded meanwhile; leave the new copy to retention.
+		dataMu.Unlock()
+		return fail(fmt.Errorf("backup changed while moving"))
+	}
+	verifiedAt := time.Now()
+	copies := []ArchiveCopy{}
+	for _, c := range stored.Copies {
+		if c.Target != backup.Storage && c.Target != target {
+			copies = append(copies, c)
+		}
+	}
+	stored.Copies = append(copies, ArchiveCopy{
+		Target:     target,
+		Status:     CopyVerified,
+		SHA256:     sum,
+		Size:       n,
+		Attempts:   1,
+		VerifiedAt: &verifiedAt,
+	})
+	stored.Storage = target
+	stored.Tier = TierCold
+	stored.Location = archiveLocation(stored)
+	if backup.Tier != TierCold {
+		serverStatus.StorageUsed -= backup.Size
+	}
+	logs = append(logs, BackupLog{
+		Timestamp: verifiedAt,
+		Level:     "info",
+		Message:   fmt.Sprintf("Archive moved from %s to cold storage on %s", backup.Storage, target),
+		DeviceID:  backup.DeviceID,
+		BackupID:  backup.ID,
+	})
+	dataMu.Unlock()
+
+	if err := deleteArchiveFrom(&backup, from); err != nil {
+		fmt.Printf("Failed to remove %s copy of backup %s: %s\n", backup.Storage, backup.ID, err)
+	}
+	return move
+}
+
+// Archives staged back from the cold tier live on the local backend under
+// "staged/" and are dropped once unused for stagedArchiveTTL.
+type stagedArchive struct {
+	key string
+	// Chunks referenced on the local backend, for a chunked archive.
+	chunks   []chunkRef
+	ready    chan struct{}
+	err      error
+	lastUsed time.Time
+}
+
+var (
+	stagingMu        sync.Mutex
+	stagedArchives   = map[string]*stagedArchive{}
+	stagedArchiveTTL = 24 * time.Hour
+)
+
+func stagedKey(backup *Backup) string {
+	return "staged/" + archiveKey(backup)
+}
+
+// openStagedArchive reads a cold archive through a local staged copy,
+// fetching it from the cold target first if needed. Concurrent readers of
+// the same archive share one fetch. The staged copy isn't re-hashed: the
+// decrypting reader authenticates every segment it reads.
+func openStagedArchive(backup *Backup) (*archiveReader, error) {
+	local := storageBackends["local"]
+
+	stagingMu.Lock()
+	staged, ok := stagedArchives[backup.ID]
+	if !ok {
+		staged = &stagedArchive{key: stagedKey(backup), ready: make(chan struct{})}
+		stagedArchives[backup.ID] = staged
+	}
+	staged.lastUsed = time.Now()
+	stagingMu.Unlock()
+
+	if !ok {
+		staged.chunks, staged.err = stageArchive(backup, local)
+		if staged.err != nil {
+			stagingMu.Lock()
+			delete(stagedArchives, backup.ID)
+			stagingMu.Unlock()
+		}
+		close(staged.ready)
+	}
+	<-staged.ready
+	if staged.err != nil {
+		return nil, staged.err
+	}
+	if backup.Chunked {
+		return openChunkedArchive(backup, local)
+	}
+	return openArchiveObject(backup, local, staged.key)
+}
+
+// stageArchive copies a cold archive to the local backend. A chunked
+// archive's chunks are referenced there rather than copied under a staged
+// key; they are returned so unstaging can release them.
+func stageArchive(backup *Backup, local Storage) ([]chunkRef, error) {
+	cold, err := storageFor(backup)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []chunkRef
+	if backup.Chunked {
+		index := backupChunkIndex(backup.ID)
+		if index == nil {
+			return nil, ErrObjectNotFound
+		}
+		if err := copyChunks(index.Chunks, cold, local); err != nil {
+			return nil, err
+		}
+		chunks = index.Chunks
+	} else {
+		key := archiveKey(backup)
+		info, err := cold.Stat(key)
+		if err != nil {
+			return nil, err
+		}
+		src, err := cold.Get(key, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		err = local.Put(stagedKey(backup), src, info.Size)
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataMu.Lock()
+	logs = append(logs, BackupLog{
+		Timestamp: time.Now(),
+		Level:     "info",
+		Message:   fmt.Sprintf("Archive staged from cold storage on %s", cold.Name()),
+		DeviceID:  backup.DeviceID,
+		BackupID:  backup.ID,
+	})
+	dataMu.Unlock()
+	return chunks, nil
+}
+
+// unstageArchive removes a backup's staged copy, if any.
+func unstageArchive(backupID string) {
+	stagingMu.Lock()
+	staged, ok := stagedArchives[backupID]
+	delete(stagedArchives, backupID)
+	stagingMu.Unlock()
+	if !ok {
+		return
+	}
+	if staged.chunks != nil {
+		releaseChunks(storageBackends["local"], staged.chunks)
+	} else {
+		storageBackends["local"].Delete(staged.key)
+	}
+}
+
+// expireStagedArchives drops staged copies unused for stagedArchiveTTL.
+func expireStagedArchives(now time.Time) {
+	stagingMu.Lock()
+	expired := []string{}
+	for id, staged := range stagedArchives {
+		select {
+		case <-staged.ready:
+		default:
+			continue // still being fetched
+		}
+		if now.Sub(staged.lastUsed) > stagedArchiveTTL {
+			expired = append(expired, id)
+		}
+	}
+	stagingMu.Unlock()
+	for _, id := range expired {
+		unstageArchive(id)
+	}
+}
+
+// tieringRoutine moves aging archives and expires staged copies on a fixed
+// interval.
+func tieringRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		runTiering(now)
+		expireStagedArchives(now)
+	}
+}
+
+// tieringSettings reads TIERING_INTERVAL (default 1h) and TIERING_STAGE_TTL
+// (default 24h).
+func tieringSettings() (time.Duration, error) {
+	if v := os.Getenv("TIERING_STAGE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TIERING_STAGE_TTL: %s", err)
+		}
+		stagedArchiveTTL = d
+	}
+	if v := os.Getenv("TIERING_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TIERING_INTERVAL: %s", err)
+		}
+		return d, nil
+	}
+	return time.Hour, nil
+}
+
+// Tiering handlers
+func getTieringRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tieringRules)
+}
+
+func createTieringRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule TieringRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validTieringRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = fmt.Sprintf("%d", nextTieringID)
+	nextTieringID++
+	tieringRules = append(tieringRules, rule)
+	setAuditResource(r, "tiering-rule/"+rule.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func updateTieringRuleHandler(w http.ResponseWriter, r *http.Request) {
+	existing := findTieringRule(mux.Vars(r)["id"])
+	if existing == nil {
+		http.Error(w, "Tiering rule not found", http.StatusNotFound)
+		return
+	}
+
+	var rule TieringRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validTieringRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = existing.ID
+	*existing = rule
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteTieringRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for i := range tieringRules {
+		if tieringRules[i].ID == id {
+			tieringRules = append(tieringRules[:i], tieringRules[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Tiering rule not found", http.StatusNotFound)
+}
+
+// runTieringHandler runs the mover now and returns what it moved.
+func runTieringHandler(w http.ResponseWriter, r *http.Request) {
+	moves := runTiering(time.Now())
+	if moves == nil {
+		http.Error(w, "Tiering is already running", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moves)
+}